@@ -46,6 +46,16 @@ class YubikeyAgent < Formula
           <string>-l</string>
           <string>#{var}/run/yubikey-agent.sock</string>
         </array>
+        <key>Sockets</key>
+        <dict>
+          <key>Listeners</key>
+          <dict>
+            <key>SockPathName</key>
+            <string>#{var}/run/yubikey-agent.sock</string>
+            <key>SockPathMode</key>
+            <integer>384</integer>
+          </dict>
+        </dict>
         <key>RunAtLoad</key><true/>
         <key>KeepAlive</key><true/>
         <key>ProcessType</key>
@@ -0,0 +1,62 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// auditLog is the -audit-log file, which gets a JSON line for each signature.
+// It records a hash of the signed data, but never the data itself.
+type auditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openAuditLog opens the audit log at path for appending, creating it if
+// needed, readable only by the current user.
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f}, nil
+}
+
+// record appends an entry for the signature sig of data with key, made for
+// the client described by peer.
+func (l *auditLog) record(key ssh.PublicKey, data []byte, sig *ssh.Signature, peer logFields) {
+	h := sha256.Sum256(data)
+	entry := logFields{
+		"time":        time.Now().UTC().Format(time.RFC3339Nano),
+		"fingerprint": ssh.FingerprintSHA256(key),
+		"algorithm":   sig.Format,
+		"data_sha256": hex.EncodeToString(h[:]),
+	}
+	if uid, ok := peer["uid"]; ok {
+		entry["uid"] = uid
+	}
+	// The fields are all strings and integers, which can't fail to marshal.
+	b, _ := json.Marshal(entry)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// A single write per line, so that lines are never interleaved, even with
+	// other processes appending to the same file.
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		logEvent("error", "error", "Failed to write to the audit log", logFields{
+			"error": err.Error(),
+		})
+	}
+}
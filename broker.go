@@ -0,0 +1,71 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// brokerControl is what the -broker control socket can do to the listeners of
+// runAgent. Sockets opened through it serve the same Agent as the others, so
+// all their requests still go through a.mu, one at a time, to the YubiKeys.
+type brokerControl struct {
+	// open starts serving the agent on a new UNIX socket at path.
+	open func(path string) error
+	// close stops serving the agent on a socket created by open, and removes
+	// it.
+	close func(path string) error
+}
+
+// serveBrokerConn handles a connection to the -broker control socket. The
+// client sends one command per line, and the agent replies to each with "OK",
+// or "ERR " followed by the error. The commands are
+//
+//	LISTEN PATH	serve the agent on a new UNIX socket at PATH
+//	CLOSE PATH	stop serving it, and remove the socket
+//
+// where PATH is absolute. Sockets stay open after the client disconnects,
+// until CLOSE or until the agent exits.
+func (b brokerControl) serveBrokerConn(c net.Conn) {
+	defer c.Close()
+	peer := peerFields(c)
+	// The socket is only accessible to the owner, unless -allow-uid or
+	// -peer-slots opened up the sockets, which they only do on Linux, where
+	// the peer can always be identified.
+	if uid, _, err := peerIDs(c); err == nil && uid != uint32(os.Getuid()) {
+		logEvent("warning", "reject", "Rejected a broker connection from another user", peer)
+		return
+	}
+	s := bufio.NewScanner(c)
+	for s.Scan() {
+		cmd, path := s.Text(), ""
+		if i := strings.IndexByte(cmd, ' '); i >= 0 {
+			cmd, path = cmd[:i], cmd[i+1:]
+		}
+		var err error
+		switch {
+		case cmd != "LISTEN" && cmd != "CLOSE":
+			err = fmt.Errorf("unknown command %q", cmd)
+		case !filepath.IsAbs(path):
+			err = fmt.Errorf("the socket path %q is not absolute", path)
+		case cmd == "LISTEN":
+			err = b.open(filepath.Clean(path))
+		case cmd == "CLOSE":
+			err = b.close(filepath.Clean(path))
+		}
+		if err != nil {
+			fmt.Fprintf(c, "ERR %s\n", strings.Replace(err.Error(), "\n", " ", -1))
+			continue
+		}
+		fmt.Fprintln(c, "OK")
+	}
+}
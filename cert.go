@@ -0,0 +1,125 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/go-piv/piv-go/piv"
+	"golang.org/x/crypto/ssh"
+)
+
+// certificate is an SSH certificate loaded with -cert.
+type certificate struct {
+	*ssh.Certificate
+	// slot is the slot holding the certified key, or nil if it can be in any.
+	slot *piv.Slot
+}
+
+// parseCertFlag loads a certificate from a -cert value, which is either a
+// path, or a slot name and a path separated by an equal sign, like
+// "9a=id_ecdsa-cert.pub".
+func parseCertFlag(value string) (certificate, error) {
+	path := value
+	var slot *piv.Slot
+	if i := strings.Index(value, "="); i > 0 {
+		if s, err := parseSlot(value[:i]); err == nil {
+			slot, path = &s, value[i+1:]
+		}
+	}
+	cert, err := loadCertificate(path)
+	if err != nil {
+		return certificate{}, err
+	}
+	return certificate{Certificate: cert, slot: slot}, nil
+}
+
+// loadCertificate reads an SSH certificate in authorized_keys format, like the
+// id_ecdsa-cert.pub files produced by ssh-keygen -s.
+func loadCertificate(path string) (*ssh.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	cert, ok := pk.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is a %s public key, not a certificate", path, pk.Type())
+	}
+	return cert, nil
+}
+
+// checkCertificates checks that every certificate in a.certs is for one of the
+// keys on the YubiKeys, in the right slot if specified. If the YubiKeys can't
+// be reached, the check is skipped, and certificates are only offered
+// alongside matching keys anyway.
+func (a *Agent) checkCertificates() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.ensureYK(); err != nil {
+		log.Println("Could not reach YubiKey to check the certificates:", err)
+		return nil
+	}
+	keys, err := a.slotKeys()
+	if err != nil {
+		return err
+	}
+Certs:
+	for _, cert := range a.certs {
+		for _, k := range keys {
+			if cert.matches(k) {
+				continue Certs
+			}
+		}
+		if cert.slot != nil {
+			return fmt.Errorf("the certificate for %s doesn't match the key in slot %s",
+				ssh.FingerprintSHA256(cert.Key), slotName(*cert.slot))
+		}
+		return fmt.Errorf("the certificate for %s doesn't match any key on the YubiKey",
+			ssh.FingerprintSHA256(cert.Key))
+	}
+	return nil
+}
+
+// matches reports whether the certificate is for the key k.
+func (cert certificate) matches(k slotKey) bool {
+	if cert.slot != nil && *cert.slot != k.slot {
+		return false
+	}
+	return bytes.Equal(cert.Key.Marshal(), k.pk.Marshal())
+}
+
+// certsForKey returns the certificates in a.certs for the key k.
+func (a *Agent) certsForKey(k slotKey) []certificate {
+	var certs []certificate
+	for _, cert := range a.certs {
+		if cert.matches(k) {
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+// isCertForKey reports whether key is a certificate for the key k. That's the
+// case for the certificates in a.certs for k, and for certificates the client
+// loaded itself, like with the CertificateFile option of ssh, which embed k.
+func (a *Agent) isCertForKey(key ssh.PublicKey, k slotKey) bool {
+	for _, cert := range a.certsForKey(k) {
+		if bytes.Equal(cert.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	cert, ok := key.(*ssh.Certificate)
+	return ok && bytes.Equal(cert.Key.Marshal(), k.pk.Marshal())
+}
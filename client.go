@@ -0,0 +1,41 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// runList implements -list. It connects as a client to the agent running at
+// addr, and prints the keys it offers, like ssh-add -l, as a self-check.
+func runList(addr string) {
+	c, err := dialAgent(addr)
+	if err != nil {
+		log.Fatalln("Failed to connect to the agent:", err)
+	}
+	defer c.Close()
+	keys, err := agent.NewClient(c).List()
+	if err != nil {
+		log.Fatalln("Failed to list the keys:", err)
+	}
+	if len(keys) == 0 {
+		fmt.Println("The agent has no keys.")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FORMAT\tFINGERPRINT\tCOMMENT")
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", k.Format, ssh.FingerprintSHA256(k), k.Comment)
+	}
+	w.Flush()
+}
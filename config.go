@@ -0,0 +1,208 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultConfigPath returns the path of the configuration file that is read
+// if -config is not set, like ~/.config/yubikey-agent/config.toml on Linux.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "yubikey-agent", "config.toml")
+}
+
+// loadConfig reads the configuration file at path, and sets the flags it
+// lists, except the ones in fixed, which were set on the command line and take
+// precedence. If mustExist is false, a missing file is not an error. The whole
+// file is parsed before any flag is set, but an invalid value can still leave
+// the flags partially set, see saveFlags.
+//
+// Each line of the file is a flag name and its value, separated by an equal
+// sign, like `pin-cache = "1h"` or `confirm = true`, optionally followed by a
+// # comment. Values can be quoted. Flags that can be repeated, like l or cert,
+// can be listed multiple times, and other names only once. Empty lines and
+// lines starting with # are ignored. The syntax is a subset of TOML, except
+// for the repeated names.
+func loadConfig(path string, mustExist bool, fixed map[string]bool) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && !mustExist {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	type setting struct {
+		line        int
+		name, value string
+	}
+	var settings []setting
+	seen := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return fmt.Errorf("%s:%d: expected name = value", path, n)
+		}
+		name := strings.TrimSpace(line[:i])
+		value, err := parseConfigValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		fl := flag.Lookup(name)
+		if name == "config" || fl == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, n, name)
+		}
+		if _, repeatable := fl.Value.(*stringsFlag); seen[name] && !repeatable {
+			return fmt.Errorf("%s:%d: duplicate setting %q", path, n, name)
+		}
+		seen[name] = true
+		settings = append(settings, setting{n, name, value})
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	for _, st := range settings {
+		if fixed[st.name] {
+			continue
+		}
+		if err := flag.Set(st.name, st.value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value for %s: %v", path, st.line, st.name, err)
+		}
+	}
+	return nil
+}
+
+// parseConfigValue parses the value of a configuration line, which is either
+// a quoted string or a bare value, followed by an optional # comment.
+func parseConfigValue(value string) (string, error) {
+	if !strings.HasPrefix(value, `"`) {
+		if i := strings.Index(value, "#"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		return value, nil
+	}
+	// Find the closing quote, skipping escaped characters.
+	end := -1
+	for i := 1; i < len(value); i++ {
+		if value[i] == '\\' {
+			i++
+			continue
+		}
+		if value[i] == '"' {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return "", errors.New("unterminated quoted value")
+	}
+	v, err := strconv.Unquote(value[:end+1])
+	if err != nil {
+		return "", fmt.Errorf("invalid quoted value: %v", err)
+	}
+	if rest := strings.TrimSpace(value[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %q after quoted value", rest)
+	}
+	return v, nil
+}
+
+// reloadableFlags are the flags that take effect when the configuration file
+// is reloaded with SIGHUP. The others are only used at startup.
+var reloadableFlags = map[string]bool{
+	"slot":                  true,
+	"enable-9d":             true,
+	"serial":                true,
+	"reader":                true,
+	"comment":               true,
+	"prefer":                true,
+	"pin-cache":             true,
+	"idle-timeout":          true,
+	"wait-for-key":          true,
+	"confirm":               true,
+	"require-touch":         true,
+	"max-signs-per-minute":  true,
+	"no-sha1":               true,
+	"no-attest-check":       true,
+	"allow-key":             true,
+	"destination":           true,
+	"no-touch-notification": true,
+	"debug":                 true,
+}
+
+// resetFlags sets all flags except the ones in fixed back to their defaults,
+// so that settings removed from the configuration file are reset on reload.
+func resetFlags(fixed map[string]bool) {
+	flag.VisitAll(func(f *flag.Flag) {
+		if fixed[f.Name] {
+			return
+		}
+		if s, ok := f.Value.(*stringsFlag); ok {
+			*s = nil
+			return
+		}
+		f.Value.Set(f.DefValue)
+	})
+}
+
+// saveFlags records the current values of all flags, and returns a function
+// that restores them, to roll back a failed reload.
+func saveFlags() (restore func()) {
+	saved := make(map[string]string)
+	lists := make(map[string]stringsFlag)
+	flag.VisitAll(func(f *flag.Flag) {
+		if s, ok := f.Value.(*stringsFlag); ok {
+			lists[f.Name] = append(stringsFlag(nil), *s...)
+			return
+		}
+		saved[f.Name] = f.Value.String()
+	})
+	return func() {
+		flag.VisitAll(func(f *flag.Flag) {
+			if s, ok := f.Value.(*stringsFlag); ok {
+				*s = lists[f.Name]
+				return
+			}
+			f.Value.Set(saved[f.Name])
+		})
+	}
+}
+
+// flagValues returns the current values of all flags, by name.
+func flagValues() map[string]string {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestReloadDebug checks that a reload keeps -debug when it was set on the
+// command line, and otherwise applies the configuration file.
+func TestReloadDebug(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		args   []string
+		config string
+		want   bool
+	}{
+		{"default", nil, "", false},
+		{"command line", []string{"-debug"}, "", true},
+		{"command line, file off", []string{"-debug"}, "debug = false\n", true},
+		{"file", nil, "debug = true\n", true},
+		{"command line off, file on", []string{"-debug=false"}, "debug = true\n", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// Use a fresh flag set, like the one main fills, so that
+			// resetFlags doesn't touch the flags of the test binary.
+			commandLineFlags := flag.CommandLine
+			t.Cleanup(func() { flag.CommandLine = commandLineFlags })
+			flag.CommandLine = flag.NewFlagSet("yubikey-agent", flag.ContinueOnError)
+			debug := logDebug
+			t.Cleanup(func() { logDebug = debug })
+			flag.BoolVar(&logDebug, "debug", false, "")
+
+			if err := flag.CommandLine.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			commandLine := make(map[string]bool)
+			flag.Visit(func(f *flag.Flag) {
+				commandLine[f.Name] = true
+			})
+
+			dir, err := ioutil.TempDir("", "yubikey-agent-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "config")
+			if err := ioutil.WriteFile(path, []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadConfig(path, true, commandLine); err != nil {
+				t.Fatal(err)
+			}
+
+			// Reload like on SIGHUP.
+			restore := saveFlags()
+			resetFlags(commandLine)
+			if err := loadConfig(path, true, commandLine); err != nil {
+				restore()
+				t.Fatal(err)
+			}
+			if logDebug != tt.want {
+				t.Errorf("logDebug is %v after reloading, expected %v", logDebug, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-piv/piv-go/piv"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentSuccess is the SSH_AGENT_SUCCESS message number, which starts the
+// response to successful extension requests.
+const agentSuccess = 6
+
+// extensions maps the names of the supported agent extensions to their
+// handlers. It is filled in by init to avoid an initialization loop with
+// queryExtension.
+var extensions map[string]func(c *connAgent, contents []byte) ([]byte, error)
+
+func init() {
+	extensions = map[string]func(c *connAgent, contents []byte) ([]byte, error){
+		"query":                                (*connAgent).queryExtension,
+		"session-bind@openssh.com":             (*connAgent).sessionBindExtension,
+		"restrict-destination-v00@openssh.com": (*connAgent).restrictDestinationExtension,
+		"attest@yubikey-agent":                 (*connAgent).attestExtension,
+		"stats@yubikey-agent":                  (*connAgent).statsExtension,
+		"ping@yubikey-agent":                   (*connAgent).pingExtension,
+		"regenerate@yubikey-agent":             (*connAgent).regenerateExtension,
+		"device-info@yubikey-agent":            (*connAgent).deviceInfoExtension,
+	}
+}
+
+func (c *connAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	handler, ok := extensions[extensionType]
+	if !ok {
+		return nil, agent.ErrExtensionUnsupported
+	}
+	return handler(c, contents)
+}
+
+// queryExtension implements the "query" extension, which returns the names of
+// the supported extensions, leaving out regenerate@yubikey-agent unless it's
+// enabled. See draft-miller-ssh-agent-04, Section 4.7.1.
+func (c *connAgent) queryExtension(contents []byte) ([]byte, error) {
+	var names []string
+	for name := range extensions {
+		if name == "regenerate@yubikey-agent" && !c.allowRegenerate {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := cryptobyte.NewBuilder([]byte{agentSuccess})
+	for _, name := range names {
+		b.AddUint32LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(name))
+		})
+	}
+	return b.Bytes()
+}
+
+// attestExtension implements the attest@yubikey-agent extension, which returns
+// the attestation certificate of a slot, along with the device attestation
+// certificate that signs it, so clients can verify the key was generated on a
+// genuine YubiKey.
+//
+// The request contents are the slot name, like "9a", and the serial number of
+// the YubiKey, which can be zero if only one is connected. The response is
+// SSH_AGENT_SUCCESS followed by the two DER certificates, as strings.
+func (c *connAgent) attestExtension(contents []byte) ([]byte, error) {
+	var req struct {
+		Slot   string
+		Serial uint32
+	}
+	if err := ssh.Unmarshal(contents, &req); err != nil {
+		return nil, fmt.Errorf("malformed attest request: %w", err)
+	}
+	slot, err := parseSlot(req.Slot)
+	if err != nil {
+		return nil, err
+	}
+	if c.slots != nil && !c.slots[slot] {
+		return nil, fmt.Errorf("slot %s is not allowed by -peer-slots", slotName(slot))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.locked {
+		return nil, ErrAgentLocked
+	}
+	if err := c.ensureYK(); err != nil {
+		return nil, fmt.Errorf("could not reach YubiKey: %w", err)
+	}
+	yk, err := c.yubiKey(req.Serial)
+	if err != nil {
+		return nil, err
+	}
+	slotCert, err := yk.Attest(slot)
+	if err != nil {
+		return nil, fmt.Errorf("could not attest slot %s: %w", slotName(slot), err)
+	}
+	ykCert, err := yk.AttestationCertificate()
+	if err != nil {
+		return nil, fmt.Errorf("could not get attestation certificate: %w", err)
+	}
+
+	b := cryptobyte.NewBuilder([]byte{agentSuccess})
+	for _, cert := range [][]byte{slotCert.Raw, ykCert.Raw} {
+		cert := cert
+		b.AddUint32LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(cert)
+		})
+	}
+	return b.Bytes()
+}
+
+// statsExtension implements the stats@yubikey-agent extension, which returns
+// the number of signatures produced since the agent started, and its uptime in
+// seconds, as two uint64. It takes no request contents, and doesn't need to
+// talk to the YubiKeys.
+func (c *connAgent) statsExtension(contents []byte) ([]byte, error) {
+	stats := struct {
+		Signatures uint64
+		Uptime     uint64
+	}{
+		Signatures: atomic.LoadUint64(&c.signatures),
+		Uptime:     uint64(time.Since(c.started) / time.Second),
+	}
+	return append([]byte{agentSuccess}, ssh.Marshal(stats)...), nil
+}
+
+// pingExtension implements the ping@yubikey-agent extension, which checks that
+// the YubiKeys are reachable, reconnecting if necessary, without asking for
+// the PIN. It takes no request contents, and the response is
+// SSH_AGENT_SUCCESS followed by the string "ok". Like device-info and
+// regenerate, it's only available to clients running as the agent user, as
+// it reveals the YubiKeys and can force reconnections.
+func (c *connAgent) pingExtension(contents []byte) ([]byte, error) {
+	if c.foreign {
+		return nil, errForeignPeer
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.locked {
+		return nil, ErrAgentLocked
+	}
+	if err := c.ensureYK(); err != nil {
+		return nil, fmt.Errorf("could not reach YubiKey: %w", err)
+	}
+	return append([]byte{agentSuccess}, ssh.Marshal(struct{ Status string }{"ok"})...), nil
+}
+
+// regenerateExtension implements the regenerate@yubikey-agent extension,
+// which replaces the key in a slot with a newly generated one, for key
+// rotation. It's only available with -allow-regenerate.
+//
+// The request contents are the slot name and serial number, like for
+// attest@yubikey-agent. The new key has the same algorithm as the old one, and
+// the same PIN and touch policies if they can be attested, or the -setup
+// defaults otherwise. The user is asked to confirm, and the management key
+// must be stored on the YubiKey, protected by the PIN, like -setup does. The
+// response is SSH_AGENT_SUCCESS followed by the new public key blob, as a
+// string.
+func (c *connAgent) regenerateExtension(contents []byte) ([]byte, error) {
+	if !c.allowRegenerate {
+		return nil, agent.ErrExtensionUnsupported
+	}
+	if c.foreign {
+		return nil, errForeignPeer
+	}
+	var req struct {
+		Slot   string
+		Serial uint32
+	}
+	if err := ssh.Unmarshal(contents, &req); err != nil {
+		return nil, fmt.Errorf("malformed regenerate request: %w", err)
+	}
+	slot, err := parseSlot(req.Slot)
+	if err != nil {
+		return nil, err
+	}
+	if c.slots != nil && !c.slots[slot] {
+		return nil, fmt.Errorf("slot %s is not allowed by -peer-slots", slotName(slot))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.locked {
+		return nil, ErrAgentLocked
+	}
+	if err := c.ensureYK(); err != nil {
+		return nil, fmt.Errorf("could not reach YubiKey: %w", err)
+	}
+	yk, err := c.yubiKey(req.Serial)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := piv.Key{
+		Algorithm:   piv.AlgorithmEC256,
+		PINPolicy:   piv.PINPolicyOnce,
+		TouchPolicy: piv.TouchPolicyAlways,
+	}
+	old, err := yk.publicKey(slot)
+	if err != nil && !errors.Is(err, ErrEmptySlot) {
+		return nil, err
+	}
+	desc := fmt.Sprintf("Replace the key in YubiKey #%d PIV slot %s with a new one?", yk.serial, slotName(slot))
+	if old != nil {
+		switch old.Type() {
+		case ssh.KeyAlgoECDSA384:
+			opts.Algorithm = piv.AlgorithmEC384
+		case ssh.KeyAlgoRSA:
+			opts.Algorithm = piv.AlgorithmRSA2048
+		}
+		if att, err := yk.attestation(slot); err == nil {
+			opts.PINPolicy = att.PINPolicy
+			opts.TouchPolicy = att.TouchPolicy
+		}
+		desc += fmt.Sprintf("\n\nThe current key %s\nwill be lost forever.", ssh.FingerprintSHA256(old))
+	}
+	ok, err := pinentryConfirm("yubikey-agent Key Regeneration", desc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ask for confirmation: %w", err)
+	}
+	if !ok {
+		return nil, errors.New("key regeneration not confirmed by the user")
+	}
+
+	pin, err := c.getPIN(yk, false)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(pin)
+	m, err := yk.Metadata(string(pin))
+	if err != nil {
+		// Like sign, don't keep a PIN that might have been rejected.
+		c.forgetPIN(yk.serial)
+		if c.keychain != nil {
+			c.keychain.delete(yk.serial)
+		}
+		return nil, fmt.Errorf("failed to read the management key: %w", err)
+	}
+	if m.ManagementKey == nil {
+		return nil, errors.New("the management key is not stored on the YubiKey, use -generate -overwrite instead")
+	}
+	pub, err := yk.GenerateKey(*m.ManagementKey, slot, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	yk.forgetSlot(slot)
+	if err := storeCertificate(yk.pivDevice, *m.ManagementKey, slot, pub); err != nil {
+		return nil, err
+	}
+	pk, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	logEvent("warning", "regenerate", "Regenerated the key in a slot", logFields{
+		"serial":      yk.serial,
+		"slot":        slotName(slot),
+		"fingerprint": ssh.FingerprintSHA256(pk),
+	})
+	return append([]byte{agentSuccess}, ssh.Marshal(struct{ Key []byte }{pk.Marshal()})...), nil
+}
+
+// formFactors are the names of the piv.Formfactor values.
+var formFactors = map[piv.Formfactor]string{
+	piv.FormfactorUSBAKeychain:          "USB-A Keychain",
+	piv.FormfactorUSBANano:              "USB-A Nano",
+	piv.FormfactorUSBCKeychain:          "USB-C Keychain",
+	piv.FormfactorUSBCNano:              "USB-C Nano",
+	piv.FormfactorUSBCLightningKeychain: "USB-C Lightning Keychain",
+}
+
+// deviceInfoExtension implements the device-info@yubikey-agent extension,
+// which describes the connected YubiKeys, for example to show which one is
+// signing. It takes no request contents. The response is SSH_AGENT_SUCCESS
+// followed, for each YubiKey, by its serial number as a uint32, and its
+// firmware version, like "5.4.3", and form factor, like "USB-C Keychain", as
+// strings. The form factor is only available from the attestation of a key,
+// and is empty if no slot has one.
+func (c *connAgent) deviceInfoExtension(contents []byte) ([]byte, error) {
+	if c.foreign {
+		return nil, errForeignPeer
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.locked {
+		return nil, ErrAgentLocked
+	}
+	if err := c.ensureYK(); err != nil {
+		return nil, fmt.Errorf("could not reach YubiKey: %w", err)
+	}
+	res := []byte{agentSuccess}
+	for _, yk := range c.yks {
+		info := struct {
+			Serial     uint32
+			Firmware   string
+			FormFactor string
+		}{
+			Serial:   yk.serial,
+			Firmware: versionString(yk.Version()),
+		}
+		for _, slot := range c.Agent.slots {
+			if att, err := yk.attestation(slot); err == nil {
+				info.FormFactor = formFactors[att.Formfactor]
+				break
+			}
+		}
+		res = append(res, ssh.Marshal(info)...)
+	}
+	return res, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestExtensions(t *testing.T) {
+	regenerate := ssh.Marshal(struct {
+		Slot   string
+		Serial uint32
+	}{"9a", 0})
+	for _, tt := range []struct {
+		name       string
+		extension  string
+		contents   []byte
+		foreign    bool
+		regenerate bool
+		wantErr    error
+	}{
+		{"query", "query", nil, false, false, nil},
+		{"query, foreign", "query", nil, true, false, nil},
+		{"stats", "stats@yubikey-agent", nil, false, false, nil},
+		{"ping", "ping@yubikey-agent", nil, false, false, nil},
+		{"ping, foreign", "ping@yubikey-agent", nil, true, false, errForeignPeer},
+		{"device-info", "device-info@yubikey-agent", nil, false, false, nil},
+		{"device-info, foreign", "device-info@yubikey-agent", nil, true, false, errForeignPeer},
+		{"regenerate, disabled", "regenerate@yubikey-agent", regenerate, false, false, agent.ErrExtensionUnsupported},
+		{"regenerate, foreign", "regenerate@yubikey-agent", regenerate, true, true, errForeignPeer},
+		{"unknown", "unknown@yubikey-agent", nil, false, false, agent.ErrExtensionUnsupported},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestAgent(t)
+			a.allowRegenerate = tt.regenerate
+			c := &connAgent{Agent: a, foreign: tt.foreign}
+			res, err := c.Extension(tt.extension, tt.contents)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("got error %v, expected %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res) == 0 || res[0] != agentSuccess {
+				t.Errorf("got response %x, expected SSH_AGENT_SUCCESS", res)
+			}
+		})
+	}
+}
+
+func TestDeviceInfoExtension(t *testing.T) {
+	a, _ := newTestAgent(t)
+	c := &connAgent{Agent: a}
+	res, err := c.Extension("device-info@yubikey-agent", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info struct {
+		Serial     uint32
+		Firmware   string
+		FormFactor string
+	}
+	if err := ssh.Unmarshal(res[1:], &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Serial != mockSerial || info.Firmware != "5.7.1" || info.FormFactor == "" {
+		t.Errorf("unexpected device info %+v", info)
+	}
+}
+
+func TestQueryExtension(t *testing.T) {
+	for _, regenerate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("allow-regenerate=%v", regenerate), func(t *testing.T) {
+			a, _ := newTestAgent(t)
+			a.allowRegenerate = regenerate
+			c := &connAgent{Agent: a}
+			res, err := c.Extension("query", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := make(map[string]bool)
+			s := cryptobyte.String(res[1:])
+			for !s.Empty() {
+				var n uint32
+				var name []byte
+				if !s.ReadUint32(&n) || !s.ReadBytes(&name, int(n)) {
+					t.Fatalf("malformed query response %x", res)
+				}
+				names[string(name)] = true
+			}
+			if !names["ping@yubikey-agent"] {
+				t.Errorf("ping@yubikey-agent missing from %v", names)
+			}
+			if names["regenerate@yubikey-agent"] != regenerate {
+				t.Errorf("regenerate@yubikey-agent listed is %v, expected %v", names["regenerate@yubikey-agent"], regenerate)
+			}
+		})
+	}
+}
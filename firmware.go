@@ -0,0 +1,66 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/go-piv/piv-go/piv"
+)
+
+// firmwareIssue is a known problem of the YubiKey firmware versions from min
+// to max, inclusive.
+type firmwareIssue struct {
+	min, max piv.Version
+	msg      string
+}
+
+var firmwareIssues = []firmwareIssue{
+	{
+		min: piv.Version{Major: 0},
+		max: piv.Version{Major: 4, Minor: 2, Patch: 99},
+		msg: "this firmware can't attest keys, so they need -no-attest-check, and the PIN policy of keys can't be read",
+	},
+	{
+		min: piv.Version{Major: 4, Minor: 2, Patch: 6},
+		max: piv.Version{Major: 4, Minor: 3, Patch: 4},
+		msg: "RSA keys generated on this firmware are weak (ROCA, YSA-2017-01), use ECDSA keys or replace the YubiKey",
+	},
+	{
+		min: piv.Version{Major: 5, Minor: 0, Patch: 0},
+		max: piv.Version{Major: 5, Minor: 6, Patch: 99},
+		msg: "ECDSA keys on this firmware can be extracted with prolonged physical access to the YubiKey (EUCLEAK, YSA-2024-03)",
+	},
+}
+
+// warnFirmware logs a warning for each known issue of the firmware of yk.
+func warnFirmware(yk *yubiKey) {
+	v := yk.Version()
+	for _, issue := range firmwareIssues {
+		if versionLess(v, issue.min) || versionLess(issue.max, v) {
+			continue
+		}
+		logEvent("warning", "firmware", "YubiKey firmware issue: "+issue.msg, logFields{
+			"serial":   yk.serial,
+			"firmware": versionString(v),
+		})
+	}
+}
+
+func versionLess(a, b piv.Version) bool {
+	if a.Major != b.Major {
+		return a.Major < b.Major
+	}
+	if a.Minor != b.Minor {
+		return a.Minor < b.Minor
+	}
+	return a.Patch < b.Patch
+}
+
+func versionString(v piv.Version) string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
@@ -3,6 +3,7 @@ module filippo.io/yubikey-agent
 go 1.14
 
 require (
+	github.com/Microsoft/go-winio v0.4.16
 	github.com/go-piv/piv-go v1.5.1-0.20200523071327-a3e5767e8b72
 	github.com/gopasspw/gopass v1.10.1
 	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
@@ -0,0 +1,85 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-piv/piv-go/piv"
+)
+
+// watchCards polls the list of smart cards every interval, and when it
+// changes, because a YubiKey was plugged in or removed, reconnects to the
+// YubiKeys right away, instead of on the next request. It never returns.
+func (a *Agent) watchCards(interval time.Duration) {
+	// Start from the cards present now, so that the first tick doesn't
+	// reconnect to YubiKeys that didn't change, forgetting their PIN.
+	var last string
+	if cards, err := piv.Cards(); err == nil {
+		last = strings.Join(cards, "\x00")
+	}
+	for range time.Tick(interval) {
+		cards, err := piv.Cards()
+		if err != nil {
+			continue
+		}
+		current := strings.Join(cards, "\x00")
+		if current == last {
+			continue
+		}
+		last = current
+		a.refreshYKs(len(cards) > 0)
+	}
+}
+
+// refreshYKs closes the YubiKeys, and reconnects to them if any is present.
+func (a *Agent) refreshYKs(present bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return
+	}
+	if len(a.yks) > 0 {
+		log.Println("The connected smart cards changed, reconnecting to the YubiKeys...")
+		atomic.AddUint64(&a.reconnects, 1)
+		a.closeYKs()
+	}
+	if !present {
+		return
+	}
+	yks, err := a.connectToYKs()
+	if err != nil {
+		log.Println("Failed to connect to the YubiKeys:", err)
+		return
+	}
+	a.setYKs(yks)
+	for _, yk := range yks {
+		log.Printf("Connected to YubiKey #%d", yk.serial)
+	}
+	a.resetIdleTimer()
+}
+
+// keepYKsAlive checks every a.keepalive that the YubiKeys are healthy, so
+// that requests in between can skip the check, and that the transaction
+// doesn't go idle. It never returns.
+func (a *Agent) keepYKsAlive() {
+	for range time.Tick(a.keepalive) {
+		a.mu.Lock()
+		if len(a.yks) > 0 && !a.locked {
+			if a.allHealthy() {
+				a.lastHealthy = time.Now()
+			} else {
+				// Make the next request check again, and reconnect.
+				a.lastHealthy = time.Time{}
+			}
+		}
+		a.mu.Unlock()
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// A keychain stores PINs in the secret store of the operating system, for
+// -pin-keychain. PINs are passed to and from the helper programs over pipes,
+// never on their command line.
+type keychain interface {
+	// load returns the PIN of the YubiKey with the given serial, or nil if
+	// it's not stored.
+	load(serial uint32) ([]byte, error)
+	store(serial uint32, pin []byte) error
+	delete(serial uint32) error
+}
+
+// keychainService is the service name the PINs are stored under.
+const keychainService = "yubikey-agent"
+
+// defaultKeychain returns the keychain for the current platform, or nil if
+// it's not supported.
+func defaultKeychain() keychain {
+	switch runtime.GOOS {
+	case "darwin":
+		return securityKeychain{}
+	case "linux":
+		return secretToolKeychain{}
+	}
+	return nil
+}
+
+// securityKeychain uses the macOS Keychain with the security tool.
+type securityKeychain struct{}
+
+func (securityKeychain) load(serial uint32) ([]byte, error) {
+	out, err := exec.Command("security", "find-generic-password",
+		"-s", keychainService, "-a", strconv.FormatUint(uint64(serial), 10), "-w").Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 44 {
+		// errSecItemNotFound.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the PIN from the Keychain: %w", err)
+	}
+	return bytes.TrimSuffix(out, []byte("\n")), nil
+}
+
+func (securityKeychain) store(serial uint32, pin []byte) error {
+	// In interactive mode, security reads the command from stdin, which keeps
+	// the PIN out of the process list.
+	quote := func(s []byte) []byte {
+		s = bytes.ReplaceAll(s, []byte(`\`), []byte(`\\`))
+		s = bytes.ReplaceAll(s, []byte(`"`), []byte(`\"`))
+		return append(append([]byte(`"`), s...), '"')
+	}
+	cmd := fmt.Sprintf("add-generic-password -U -s %s -a %d -l %s -w ",
+		keychainService, serial, quote([]byte(fmt.Sprintf("YubiKey #%d PIN", serial))))
+	line := append([]byte(cmd), quote(pin)...)
+	line = append(line, '\n')
+	defer zeroBytes(line)
+	c := exec.Command("security", "-i")
+	c.Stdin = bytes.NewReader(line)
+	if out, err := c.CombinedOutput(); err != nil || len(bytes.TrimSpace(out)) > 0 {
+		return fmt.Errorf("failed to store the PIN in the Keychain: %v %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (securityKeychain) delete(serial uint32) error {
+	return exec.Command("security", "delete-generic-password",
+		"-s", keychainService, "-a", strconv.FormatUint(uint64(serial), 10)).Run()
+}
+
+// secretToolKeychain uses the Secret Service, like GNOME Keyring or KWallet,
+// with the secret-tool program of libsecret.
+type secretToolKeychain struct{}
+
+func (secretToolKeychain) attributes(serial uint32) []string {
+	return []string{"service", keychainService, "serial", strconv.FormatUint(uint64(serial), 10)}
+}
+
+func (k secretToolKeychain) load(serial uint32) ([]byte, error) {
+	out, err := exec.Command("secret-tool", append([]string{"lookup"}, k.attributes(serial)...)...).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(out) == 0 {
+		// secret-tool exits with status 1 and no output if the secret is
+		// not found.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the PIN from the Secret Service: %w", err)
+	}
+	return bytes.TrimSuffix(out, []byte("\n")), nil
+}
+
+func (k secretToolKeychain) store(serial uint32, pin []byte) error {
+	label := fmt.Sprintf("--label=YubiKey #%d PIN", serial)
+	c := exec.Command("secret-tool", append([]string{"store", label}, k.attributes(serial)...)...)
+	c.Stdin = bytes.NewReader(pin)
+	if out, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to store the PIN in the Secret Service: %v %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (k secretToolKeychain) delete(serial uint32) error {
+	return exec.Command("secret-tool", append([]string{"clear"}, k.attributes(serial)...)...).Run()
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keyFormats are the -format values of -print-key.
+var keyFormats = map[string]bool{"ssh": true, "pem": true, "jwk": true}
+
+// formatPublicKey encodes pk for -print-key as an authorized_keys line with
+// the given comment ("ssh"), a PEM SubjectPublicKeyInfo ("pem"), or a JSON
+// Web Key, see RFC 7517 and RFC 7518 ("jwk").
+func formatPublicKey(pk ssh.PublicKey, format, comment string) (string, error) {
+	if format == "ssh" {
+		line := bytes.TrimSuffix(ssh.MarshalAuthorizedKey(pk), []byte("\n"))
+		return fmt.Sprintf("%s %s", line, comment), nil
+	}
+	pub := pk.(ssh.CryptoPublicKey).CryptoPublicKey()
+	switch format {
+	case "pem":
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		b := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+		return string(bytes.TrimSuffix(b, []byte("\n"))), nil
+	case "jwk":
+		jwk, err := publicKeyJWK(pub)
+		if err != nil {
+			return "", err
+		}
+		b, err := json.Marshal(jwk)
+		return string(b), err
+	}
+	return "", fmt.Errorf("unknown key format %q", format)
+}
+
+func publicKeyJWK(pub interface{}) (map[string]string, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		params := pub.Curve.Params()
+		size := (params.BitSize + 7) / 8
+		return map[string]string{
+			"kty": "EC",
+			"crv": params.Name,
+			"x":   b64(padBigInt(pub.X, size)),
+			"y":   b64(padBigInt(pub.Y, size)),
+		}, nil
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"n":   b64(pub.N.Bytes()),
+			"e":   b64(big.NewInt(int64(pub.E)).Bytes()),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", pub)
+}
+
+// padBigInt returns n as a big-endian byte string of exactly size bytes, as
+// required for JWK EC coordinates.
+func padBigInt(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+/*
+#include <launch.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// launchdListener returns the socket passed by launchd for the "Listeners"
+// entry in the Sockets dictionary of the job, or nil if there is none. See
+// launch_activate_socket(3).
+func launchdListener() (net.Listener, error) {
+	name := C.CString("Listeners")
+	defer C.free(unsafe.Pointer(name))
+	var fds *C.int
+	var cnt C.size_t
+	if rc := C.launch_activate_socket(name, &fds, &cnt); rc != 0 {
+		switch err := syscall.Errno(rc); err {
+		case syscall.ENOENT, syscall.ESRCH:
+			// The job has no such socket, or is not run by launchd.
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("launch_activate_socket failed: %w", err)
+		}
+	}
+	defer C.free(unsafe.Pointer(fds))
+	if cnt != 1 {
+		return nil, fmt.Errorf("expected one socket, got %d", cnt)
+	}
+	f := os.NewFile(uintptr(*fds), "launchd socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
@@ -0,0 +1,17 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !darwin && !windows
+// +build !darwin,!windows
+
+package main
+
+import "net"
+
+// launchdListener always returns nil, as launchd only exists on macOS.
+func launchdListener() (net.Listener, error) {
+	return nil, nil
+}
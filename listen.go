@@ -0,0 +1,79 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+)
+
+// tcpPrefix marks a -l address as a TCP address rather than a UNIX socket.
+const tcpPrefix = "tcp://"
+
+// unixPrefix optionally marks a -l address as a UNIX socket.
+const unixPrefix = "unix:"
+
+// abstractSocketName returns the name of the Linux abstract socket addressed
+// by a -l value like "@name" or "unix:@name", and whether it is one.
+func abstractSocketName(path string) (string, bool) {
+	path = strings.TrimPrefix(path, unixPrefix)
+	if !strings.HasPrefix(path, "@") || len(path) == 1 {
+		return "", false
+	}
+	return path, true
+}
+
+// listenAbstract listens on the Linux abstract socket name, like "@name".
+// Abstract sockets have no file, so there is nothing to remove or clean up,
+// and they are only reachable from the same network namespace.
+func listenAbstract(name string) (net.Listener, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("abstract sockets like %q are only supported on Linux", name)
+	}
+	// The net package translates a leading @ to the NUL byte that marks
+	// abstract socket addresses.
+	return net.Listen("unix", name)
+}
+
+// listenTCP listens on addr, like "127.0.0.1:4242". Unlike a UNIX socket, a
+// TCP port can be reached by any local user, and possibly by other machines,
+// so addresses that are not loopback are rejected unless allowRemote is set.
+func listenTCP(addr string, allowRemote bool) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TCP address %q: %w", addr, err)
+	}
+	if !allowRemote {
+		if host == "" {
+			return nil, fmt.Errorf("refusing to listen on all interfaces without -allow-remote-tcp")
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %q: %w", host, err)
+		}
+		for _, ip := range ips {
+			if !ip.IsLoopback() {
+				return nil, fmt.Errorf("refusing to listen on non-loopback address %v without -allow-remote-tcp", ip)
+			}
+		}
+	}
+	return net.Listen("tcp", addr)
+}
+
+// dialAgent connects to an agent at addr, which is a -l value or the value of
+// SSH_AUTH_SOCK.
+func dialAgent(addr string) (net.Conn, error) {
+	if strings.HasPrefix(addr, tcpPrefix) {
+		return net.Dial("tcp", strings.TrimPrefix(addr, tcpPrefix))
+	}
+	if name, ok := abstractSocketName(addr); ok {
+		return net.Dial("unix", name)
+	}
+	return dial(strings.TrimPrefix(addr, unixPrefix))
+}
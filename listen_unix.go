@@ -0,0 +1,85 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// socketMode is the permission of the UNIX sockets created by listen. Only
+// the owner can connect, unless other users are allowed with -allow-uid or
+// -peer-slots, in which case serveConn checks who is connecting.
+var socketMode os.FileMode = 0600
+
+// listen listens on the UNIX socket at path, replacing any stale socket. It
+// refuses to replace anything else, as the path can come from a -broker
+// client.
+func listen(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket == 0 {
+		return nil, fmt.Errorf("%s exists and is not a socket", path)
+	}
+	os.Remove(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, fmt.Errorf("failed to create UNIX socket folder: %w", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// The umask might leave the socket open to other users, so set the mode
+	// explicitly, and not just when creating it.
+	if err := os.Chmod(path, socketMode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set the UNIX socket permissions: %w", err)
+	}
+	return l, nil
+}
+
+// dial connects to the UNIX socket at path.
+func dial(path string) (net.Conn, error) {
+	return net.Dial("unix", path)
+}
+
+// activationListener returns the socket passed by launchd or by systemd socket
+// activation, or nil if there is none.
+func activationListener() (net.Listener, error) {
+	if l, err := launchdListener(); err != nil || l != nil {
+		return l, err
+	}
+	return systemdListener()
+}
+
+// systemdListener returns the socket passed by systemd socket activation, or
+// nil if there is none. See sd_listen_fds(3).
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS value %q", os.Getenv("LISTEN_FDS"))
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("expected one socket, got %d", n)
+	}
+	const listenFDsStart = 3
+	syscall.CloseOnExec(listenFDsStart)
+	f := os.NewFile(listenFDsStart, "systemd socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
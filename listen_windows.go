@@ -0,0 +1,44 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// socketMode is only used for UNIX sockets.
+var socketMode os.FileMode = 0600
+
+// listen listens on the named pipe with the given name. The \\.\pipe\ prefix
+// is optional, so for example "openssh-ssh-agent" is the same as the default
+// pipe of OpenSSH for Windows, \\.\pipe\openssh-ssh-agent.
+func listen(name string) (net.Listener, error) {
+	return winio.ListenPipe(pipeName(name), nil)
+}
+
+// dial connects to the named pipe with the given name, like listen.
+func dial(name string) (net.Conn, error) {
+	return winio.DialPipe(pipeName(name), nil)
+}
+
+func pipeName(name string) string {
+	const prefix = `\\.\pipe\`
+	if !strings.HasPrefix(name, prefix) {
+		name = prefix + name
+	}
+	return name
+}
+
+// activationListener always returns nil, as there is no socket activation on
+// Windows.
+func activationListener() (net.Listener, error) {
+	return nil, nil
+}
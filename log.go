@@ -0,0 +1,106 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logJSON is set by -log-format json, and makes the agent log one JSON object
+// per line instead of human-readable text.
+var logJSON bool
+
+// logDebug is set by -debug, and makes the text format include the debug
+// events too.
+var logDebug bool
+
+// logMu serializes writes of JSON lines to stderr.
+var logMu sync.Mutex
+
+// logFields are the structured fields of a log event, like serial and slot.
+type logFields map[string]interface{}
+
+// setLogFormat configures the log package for format, "text" or "json".
+func setLogFormat(format string) error {
+	switch format {
+	case "text":
+		logJSON = false
+	case "json":
+		logJSON = true
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{os.Stderr})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// logEvent logs a structured event, such as "connect", "sign", or "error".
+// Events at the "debug" level are only logged in JSON mode, as they would be
+// too noisy for interactive users, unless -debug is set.
+func logEvent(level, event, msg string, fields logFields) {
+	if !logJSON {
+		if level == "debug" && !logDebug {
+			return
+		}
+		var keys []string
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var b strings.Builder
+		b.WriteString(msg)
+		for _, k := range keys {
+			fmt.Fprintf(&b, " %s=%v", k, fields[k])
+		}
+		log.Println(b.String())
+		return
+	}
+	entry := logFields{}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["event"] = event
+	entry["msg"] = msg
+	writeJSONLog(os.Stderr, entry)
+}
+
+func writeJSONLog(w io.Writer, entry logFields) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(logFields{"level": "error", "msg": err.Error()})
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	w.Write(append(b, '\n'))
+}
+
+// jsonLogWriter wraps the plain log.Print lines in JSON objects, so that the
+// whole output is valid JSON lines in JSON mode.
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+func (j jsonLogWriter) Write(p []byte) (int, error) {
+	writeJSONLog(j.w, logFields{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": "info",
+		"event": "log",
+		"msg":   strings.TrimSuffix(string(p), "\n"),
+	})
+	return len(p), nil
+}
@@ -7,29 +7,38 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
-	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/go-piv/piv-go/piv"
-	"github.com/gopasspw/gopass/pkg/pinentry"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/terminal"
@@ -43,224 +52,1942 @@ func main() {
 		fmt.Fprintf(os.Stderr, "\n")
 		fmt.Fprintf(os.Stderr, "\t\tGenerate a new SSH key on the attached YubiKey.\n")
 		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\t-algo ALGORITHM\tUse ec256 (default), ec384, or rsa2048.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -generate -slot SLOT\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\tGenerate a new SSH key in SLOT, keeping the other slots.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\t-algo ALGORITHM\tUse ec256 (default), ec384, or rsa2048.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-pin-policy POLICY\tUse never, once (default), or always.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-touch-policy POLICY\tUse never, always (default), or cached.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-overwrite\tReplace the key already in SLOT.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -print-key\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\tPrint the SSH public key of the attached YubiKey.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-format FORMAT\tPrint it as ssh (default), pem, or jwk.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -reset\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\tDelete all PIV keys and reset the PIN, PUK, and Management Key.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -status\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\tPrint the state of the attached YubiKeys and their keys.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -test-sign\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\tSign and verify a test challenge with the key in slot 9a (or -slot).\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -list\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\tPrint the keys offered by the agent at $SSH_AUTH_SOCK (or -l PATH).\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -version\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\tPrint the version of yubikey-agent.\n")
+		fmt.Fprintf(os.Stderr, "\n")
 		fmt.Fprintf(os.Stderr, "\tyubikey-agent -l PATH\n")
 		fmt.Fprintf(os.Stderr, "\n")
 		fmt.Fprintf(os.Stderr, "\t\tRun the agent, listening on the UNIX socket at PATH.\n")
+		fmt.Fprintf(os.Stderr, "\t\tOn Windows, PATH is the name of a named pipe.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-l can be repeated to listen on multiple sockets.\n")
+		fmt.Fprintf(os.Stderr, "\t\tWithout -l, $YUBIKEY_AGENT_SOCK is used if set.\n")
+		fmt.Fprintf(os.Stderr, "\t\tWith systemd or launchd socket activation, -l is not needed.\n")
+		fmt.Fprintf(os.Stderr, "\t\tWith -allow-tcp, PATH can be tcp://127.0.0.1:PORT.\n")
+		fmt.Fprintf(os.Stderr, "\t\tOn Linux, PATH can be @NAME for an abstract socket.\n")
 		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\t-reader NAME\tOnly use the smart cards in readers whose name contains NAME.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-serial NUMBER\tOnly use the YubiKey with this serial number.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-slot SLOT\tOnly use the key in this PIV slot, like 9a.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-enable-9d\tAlso use the key in the Key Management (9d) slot.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-destination [FROM>][USER@]HOST\tOnly authenticate to HOST.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-allow-key FINGERPRINT\tOnly use the key with this SHA256 fingerprint.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-broker PATH\tListen on a control socket that can open more agent sockets.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-allow-uid UID\tAlso let the user UID connect to the agent.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-peer-slots uid:ID=SLOTS\tOnly offer SLOTS to clients running as a user or group.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-prefer ALGORITHMS\tList keys of these algorithms first, like ecdsa,rsa.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-comment TEMPLATE\tLabel the keys, like \"laptop-{{.Serial}}-{{.Slot}}\".\n")
+		fmt.Fprintf(os.Stderr, "\t\t-cert [SLOT=]PATH\tOffer the SSH certificate at PATH alongside its key.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-pinentry PROGRAM\tUse PROGRAM to ask for the PIN, like pinentry-curses.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-pin-timeout DURATION\tClose the pinentry dialogs after DURATION.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-pin-ontop\tAsk pinentry to stay in front of other windows.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-pin-helper-socket PATH\tAsk for the PIN through the helper listening on PATH.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-askpass PROGRAM\tUse the SSH_ASKPASS style PROGRAM to ask for the PIN.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-no-pinentry\tRead the PIN from the terminal or stdin.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-pin-cache DURATION\tRemember the PIN for DURATION (e.g. 1m).\n")
+		fmt.Fprintf(os.Stderr, "\t\t-pin-keychain\tRemember the PIN in the macOS Keychain or Secret Service.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-hotplug DURATION\tCheck for YubiKeys being plugged in every DURATION.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-wait-for-key DURATION\tWait up to DURATION for a YubiKey to be plugged in.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-keepalive DURATION\tCheck the YubiKeys every DURATION instead of on each request.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-idle-timeout DURATION\tClose the YubiKeys after DURATION without requests.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-max-signs-per-minute N\tRefuse signatures beyond N per minute (default 60).\n")
+		fmt.Fprintf(os.Stderr, "\t\t-sign-timeout DURATION\tFail signatures taking longer than DURATION (default 20s).\n")
+		fmt.Fprintf(os.Stderr, "\t\t-allow-regenerate\tLet clients replace keys with regenerate@yubikey-agent.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-config PATH\tRead flags from PATH, see the README.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-audit-log PATH\tAppend a line to PATH for each signature.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-once\tExit after a single signature.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-pidfile PATH\tWrite the process ID to PATH.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-log-format FORMAT\tLog as text (default) or json lines.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-debug\tAlso log debug events in the text format.\n")
+		fmt.Fprintf(os.Stderr, "\t\t-metrics-addr ADDR\tServe Prometheus metrics at http://ADDR/metrics.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+
+	configFlag := flag.String("config", "", "path of the configuration file (default "+defaultConfigPath()+")")
+	versionFlag := flag.Bool("version", false, "print the version and exit")
+	var socketPaths stringsFlag
+	flag.Var(&socketPaths, "l", "agent: path of the UNIX socket (or name of the Windows named pipe) to listen on (can be repeated)")
+	resetFlag := flag.Bool("really-delete-all-piv-keys", false, "setup: reset the PIV applet")
+	setupFlag := flag.Bool("setup", false, "setup: configure a new YubiKey")
+	algoFlag := flag.String("algo", "ec256", "setup, generate: algorithm of the new key: ec256, ec384, or rsa2048")
+	serialFlag := flag.Uint("serial", 0, "agent: serial number of the YubiKey to use, instead of all connected ones")
+	formatFlag := flag.String("format", "ssh", "print-key: format of the public key: ssh, pem, or jwk")
+	printKeyFlag := flag.Bool("print-key", false, "print the SSH public key in the Authentication slot (or -slot) and exit")
+	resetCommandFlag := flag.Bool("reset", false, "reset the PIV applet of the YubiKey to the factory defaults, deleting all keys, and exit")
+	statusFlag := flag.Bool("status", false, "print the state of the YubiKeys and their slots and exit")
+	testSignFlag := flag.Bool("test-sign", false, "sign and verify a test challenge with the key in the Authentication slot (or -slot) and exit")
+	listFlag := flag.Bool("list", false, "print the keys offered by the agent running at $SSH_AUTH_SOCK (or -l) and exit")
+	generateFlag := flag.Bool("generate", false, "generate a new key in the Authentication slot (or -slot), print its SSH public key, and exit")
+	pinPolicyFlag := flag.String("pin-policy", "once", "generate: PIN policy of the new key: never, once, or always")
+	touchPolicyFlag := flag.String("touch-policy", "always", "generate: touch policy of the new key: never, always, or cached")
+	overwriteFlag := flag.Bool("overwrite", false, "generate: replace the key already in the slot, if any")
+	var certFlags stringsFlag
+	flag.Var(&certFlags, "cert", "agent: path of an SSH certificate to offer alongside its key, optionally prefixed by the slot like 9a=PATH (can be repeated)")
+	var destinationFlags stringsFlag
+	flag.Var(&destinationFlags, "destination", "agent: only sign SSH user authentications to this destination, like host, user@host, or jump>host, with host keys from known_hosts (can be repeated)")
+	var allowKeyFlags stringsFlag
+	flag.Var(&allowKeyFlags, "allow-key", "agent: only offer the key with this SHA256 fingerprint, like SHA256:... (can be repeated)")
+	brokerFlag := flag.String("broker", "", "agent: listen on this control UNIX socket, through which more agent sockets can be opened and closed")
+	var allowUIDFlags stringsFlag
+	flag.Var(&allowUIDFlags, "allow-uid", "agent: also let this user ID connect to the agent, besides the owner (can be repeated, Linux only)")
+	var peerSlotsFlags stringsFlag
+	flag.Var(&peerSlotsFlags, "peer-slots", "agent: only offer the keys in these slots to clients running as a user or group, like uid:1000=9a or group:deploy=9c,82 (can be repeated, Linux only)")
+	preferFlag := flag.String("prefer", "", "agent: comma-separated key algorithms to list first, in order, like ecdsa,rsa")
+	enable9dFlag := flag.Bool("enable-9d", false, "agent: also offer the key in the Key Management (9d) slot")
+	readerFlag := flag.String("reader", "", "only use the smart cards whose reader name contains this, instead of those that look like YubiKeys")
+	slotFlag := flag.String("slot", "", "only use the key in this PIV slot, like 9a or 9c")
+	requireTouchFlag := flag.Bool("require-touch", false, "agent: ask for confirmation before signatures with keys that don't require a touch")
+	confirmFlag := flag.Bool("confirm", false, "agent: ask for confirmation before every signature")
+	noTouchNotificationFlag := flag.Bool("no-touch-notification", false, "agent: don't show a notification when the YubiKey needs to be touched")
+	allowRegenerateFlag := flag.Bool("allow-regenerate", false, "agent: let clients replace the key in a slot with the regenerate@yubikey-agent extension")
+	pinKeychainFlag := flag.Bool("pin-keychain", false, "agent: store the PIN in the macOS Keychain or the Secret Service, and read it from there")
+	pinCacheFlag := flag.Duration("pin-cache", 0, "agent: how long to remember the PIN for, or 0 to never remember it")
+	allowTCPFlag := flag.Bool("allow-tcp", false, "agent: allow listening on a tcp://HOST:PORT address with -l")
+	allowRemoteTCPFlag := flag.Bool("allow-remote-tcp", false, "agent: allow -l tcp:// and -metrics-addr addresses that are not loopback")
+	metricsAddrFlag := flag.String("metrics-addr", "", "agent: serve Prometheus metrics over HTTP at this address, like 127.0.0.1:9999")
+	noAttestCheckFlag := flag.Bool("no-attest-check", false, "agent: also use keys that can't be attested as generated on a genuine YubiKey")
+	noPinentryFlag := flag.Bool("no-pinentry", false, "agent: read the PIN from the terminal or stdin instead of using pinentry")
+	pinHelperSocketFlag := flag.String("pin-helper-socket", "", "agent: ask for the PIN through the program listening on this UNIX socket, see the README")
+	askpassFlag := flag.String("askpass", defaultAskpass(), "agent: ask for the PIN with this SSH_ASKPASS style program instead of pinentry")
+	pinTimeoutFlag := flag.Duration("pin-timeout", 0, "agent: close the pinentry dialogs after this long, or 0 for the pinentry default")
+	pinOnTopFlag := flag.Bool("pin-ontop", false, "agent: ask pinentry to grab the keyboard and stay in front of other windows")
+	pinentryFlag := flag.String("pinentry", pinentryBinary, "path or name of the pinentry program to use")
+	noSHA1Flag := flag.Bool("no-sha1", false, "agent: never make SHA-1 RSA signatures, use SHA-256 when the client doesn't ask for SHA-2")
+	commentFlag := flag.String("comment", "", "template for the key comments, like \"work-{{.Serial}}-{{.Slot}}\"")
+	keepaliveFlag := flag.Duration("keepalive", 0, "agent: check the YubiKeys at this interval instead of before every request, for faster back-to-back signatures")
+	waitForKeyFlag := flag.Duration("wait-for-key", 0, "agent: when no YubiKey is plugged in, wait this long for one before failing requests")
+	idleTimeoutFlag := flag.Duration("idle-timeout", 0, "agent: close the YubiKeys after this long without requests, or 0 to keep them open")
+	maxSignsFlag := flag.Int("max-signs-per-minute", 60, "agent: refuse signatures beyond this rate, allowing bursts of the same size, or 0 for no limit")
+	signTimeoutFlag := flag.Duration("sign-timeout", 20*time.Second, "agent: how long to wait for a signature, like for the YubiKey to be touched, or 0 to wait forever")
+	hotplugFlag := flag.Duration("hotplug", 0, "agent: check for YubiKeys being plugged in or removed at this interval, like 2s, or 0 to only check on requests")
+	auditLogFlag := flag.String("audit-log", "", "agent: append a line for each signature to this file, with a hash of the signed data")
+	onceFlag := flag.Bool("once", false, "agent: exit after the first signature, once its client disconnects")
+	pidfileFlag := flag.String("pidfile", "", "agent: write the process ID to this file, and remove it on exit")
+	logFormatFlag := flag.String("log-format", "text", "agent: format of the logs, text or json")
+	flag.BoolVar(&logDebug, "debug", false, "agent: also log debug events, like key and signature algorithm choices, in the text format")
+	// -mock is for development, and is left out of the usage text.
+	mockFlag := flag.Bool("mock", false, "use a simulated YubiKey with in-memory keys, for development")
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	// Flags set on the command line take precedence over the configuration
+	// file, also when it's reloaded.
+	commandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = true
+	})
+	readConfig := func() error {
+		if *configFlag != "" {
+			return loadConfig(*configFlag, true, commandLine)
+		} else if path := defaultConfigPath(); path != "" {
+			return loadConfig(path, false, commandLine)
+		}
+		return nil
+	}
+	if err := readConfig(); err != nil {
+		log.Fatalln("Failed to load configuration:", err)
+	}
+	// Service launchers can set the socket in the environment instead, but -l
+	// takes precedence, from the command line or the configuration file.
+	if path := os.Getenv("YUBIKEY_AGENT_SOCK"); path != "" && len(socketPaths) == 0 {
+		socketPaths = stringsFlag{path}
+	}
+	if err := setLogFormat(*logFormatFlag); err != nil {
+		log.Fatalln(err)
+	}
+	pinentryBinary = *pinentryFlag
+	pinentryTimeout = *pinTimeoutFlag
+	pinentryGrab = *pinOnTopFlag
+
+	a := &Agent{
+		started:         time.Now(),
+		signTimeout:     *signTimeoutFlag,
+		noPinentry:      *noPinentryFlag,
+		allowRegenerate: *allowRegenerateFlag,
+		askpass:         *askpassFlag,
+		pinHelperSocket: *pinHelperSocketFlag,
+	}
+	a.keepalive = *keepaliveFlag
+	if *mockFlag {
+		m, err := newMockYubiKey()
+		if err != nil {
+			log.Fatalln("Failed to create the simulated YubiKey:", err)
+		}
+		a.mock = m
+		log.Printf("Using a simulated YubiKey #%d instead of the smart cards, with PIN %s", mockSerial, piv.DefaultPIN)
+	}
+	if *onceFlag {
+		a.once = true
+		a.onceDone = make(chan struct{})
+	}
+	if *pinKeychainFlag {
+		a.keychain = defaultKeychain()
+		if a.keychain == nil {
+			log.Fatalln("-pin-keychain is only supported on macOS and Linux.")
+		}
+	}
+	if *auditLogFlag != "" {
+		l, err := openAuditLog(*auditLogFlag)
+		if err != nil {
+			log.Fatalln("Failed to open the audit log:", err)
+		}
+		a.audit = l
+	}
+	if len(peerSlotsFlags) > 0 && runtime.GOOS != "linux" {
+		log.Fatalln("-peer-slots is only supported on Linux.")
+	}
+	for _, value := range peerSlotsFlags {
+		r, err := parsePeerRule(value)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		a.peerRules = append(a.peerRules, r)
+	}
+	if len(allowUIDFlags) > 0 && runtime.GOOS != "linux" {
+		log.Fatalln("-allow-uid is only supported on Linux.")
+	}
+	if runtime.GOOS == "linux" && (len(a.peerRules) == 0 || len(allowUIDFlags) > 0) {
+		// Check who connects even to sockets that only the owner can reach,
+		// as abstract sockets have no permissions.
+		a.allowedUIDs = map[uint32]bool{uint32(os.Getuid()): true}
+		for _, value := range allowUIDFlags {
+			uid, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				log.Fatalf("Invalid -allow-uid %q, expected a numeric user ID.", value)
+			}
+			a.allowedUIDs[uint32(uid)] = true
+		}
+	}
+	if len(allowUIDFlags) > 0 || len(a.peerRules) > 0 {
+		// Let the other users reach the socket, and check them in serveConn.
+		socketMode = 0666
+	}
+	notifier := defaultNotifier()
+	// configure applies the settings that can be changed by reloading the
+	// configuration file. If any is invalid, none is applied.
+	configure := func() error {
+		var comment *template.Template
+		if *commentFlag != "" {
+			t, err := parseCommentTemplate(*commentFlag)
+			if err != nil {
+				return fmt.Errorf("invalid -comment template: %w", err)
+			}
+			comment = t
+		}
+		var allowedKeys map[string]bool
+		for _, fp := range allowKeyFlags {
+			if !strings.HasPrefix(fp, "SHA256:") {
+				return fmt.Errorf("invalid -allow-key %q, expected a SHA256 fingerprint like printed by ssh-add -l", fp)
+			}
+			if allowedKeys == nil {
+				allowedKeys = make(map[string]bool)
+			}
+			allowedKeys[fp] = true
+		}
+		prefer, err := parsePrefer(*preferFlag)
+		if err != nil {
+			return err
+		}
+		var destinations []destinationConstraint
+		for _, value := range destinationFlags {
+			dc, err := parseDestination(value)
+			if err != nil {
+				return err
+			}
+			destinations = append(destinations, dc)
+		}
+		var slots []piv.Slot
+		for _, slot := range allSlots {
+			if slot == piv.SlotKeyManagement && !*enable9dFlag {
+				continue
+			}
+			slots = append(slots, slot)
+		}
+		if *slotFlag != "" {
+			slot, err := parseSlot(*slotFlag)
+			if err != nil {
+				return err
+			}
+			slots = []piv.Slot{slot}
+		}
+
+		if a.keepalive > 0 && *idleTimeoutFlag > 0 {
+			return errors.New("-keepalive and -idle-timeout can't be used together")
+		}
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.slots = slots
+		a.wantSerial = uint32(*serialFlag)
+		a.reader = *readerFlag
+		a.pinCacheTTL = *pinCacheFlag
+		a.idleTimeout = *idleTimeoutFlag
+		a.waitForKey = *waitForKeyFlag
+		a.confirm = *confirmFlag
+		a.requireTouch = *requireTouchFlag
+		a.maxSignsPerMinute = *maxSignsFlag
+		a.noSHA1 = *noSHA1Flag
+		// The simulated YubiKey can't be attested by the Yubico root.
+		a.noAttestCheck = *noAttestCheckFlag || a.mock != nil
+		a.comment = comment
+		a.prefer = prefer
+		a.allowedKeys = allowedKeys
+		a.destinations = destinations
+		a.notifier = notifier
+		if *noTouchNotificationFlag {
+			a.notifier = nil
+		}
+		return nil
+	}
+	if err := configure(); err != nil {
+		log.Fatalln(err)
+	}
+	// reload re-reads the configuration file, on SIGHUP. Flags that are only
+	// used at startup, like -l, are not applied until restarting.
+	reload := func() {
+		before := flagValues()
+		restore := saveFlags()
+		resetFlags(commandLine)
+		if err := readConfig(); err != nil {
+			restore()
+			log.Println("Failed to reload the configuration, keeping the current settings:", err)
+			return
+		}
+		if err := configure(); err != nil {
+			restore()
+			log.Println("Failed to reload the configuration, keeping the current settings:", err)
+			return
+		}
+		after := flagValues()
+		for _, name := range sortedKeys(after) {
+			if before[name] == after[name] {
+				continue
+			}
+			if reloadableFlags[name] {
+				log.Printf("Reloaded -%s = %q", name, after[name])
+			} else {
+				log.Printf("Ignoring the new value of -%s, restart yubikey-agent to apply it", name)
+			}
+		}
+	}
+
+	switch {
+	case *versionFlag:
+		runVersion()
+	case *setupFlag:
+		log.SetFlags(0)
+		alg, ok := setupAlgorithms[*algoFlag]
+		if !ok {
+			log.Fatalf("Unknown algorithm %q.", *algoFlag)
+		}
+		if a.mock != nil {
+			log.Fatalln("-setup can't be used with -mock.")
+		}
+		yk := connectForSetup(*readerFlag)
+		if *resetFlag {
+			runReset(yk)
+		}
+		runSetup(yk, alg)
+	case *generateFlag:
+		log.SetFlags(0)
+		alg, ok := setupAlgorithms[*algoFlag]
+		if !ok {
+			log.Fatalf("Unknown algorithm %q.", *algoFlag)
+		}
+		pinPolicy, ok := pinPolicies[*pinPolicyFlag]
+		if !ok {
+			log.Fatalf("Unknown PIN policy %q.", *pinPolicyFlag)
+		}
+		touchPolicy, ok := touchPolicies[*touchPolicyFlag]
+		if !ok {
+			log.Fatalf("Unknown touch policy %q.", *touchPolicyFlag)
+		}
+		slot := piv.SlotAuthentication
+		if len(a.slots) == 1 {
+			slot = a.slots[0]
+		}
+		runGenerate(a, slot, piv.Key{
+			Algorithm:   alg,
+			PINPolicy:   pinPolicy,
+			TouchPolicy: touchPolicy,
+		}, *overwriteFlag)
+	case *resetCommandFlag:
+		log.SetFlags(0)
+		runResetCommand(a)
+	case *statusFlag:
+		log.SetFlags(0)
+		runStatus(a)
+	case *testSignFlag:
+		log.SetFlags(0)
+		slot := piv.SlotAuthentication
+		if len(a.slots) == 1 {
+			slot = a.slots[0]
+		}
+		runTestSign(a, slot)
+		a.Close()
+	case *listFlag:
+		log.SetFlags(0)
+		addr := os.Getenv("SSH_AUTH_SOCK")
+		if len(socketPaths) > 0 {
+			addr = socketPaths[0]
+		}
+		if addr == "" {
+			log.Fatalln("SSH_AUTH_SOCK is not set, pass the agent socket with -l.")
+		}
+		runList(addr)
+	case *printKeyFlag:
+		log.SetFlags(0)
+		slot := piv.SlotAuthentication
+		if len(a.slots) == 1 {
+			slot = a.slots[0]
+		}
+		if !keyFormats[*formatFlag] {
+			log.Fatalf("Unknown -format %q, expected ssh, pem, or jwk.", *formatFlag)
+		}
+		runPrintKey(a, slot, *formatFlag)
+	default:
+		l, err := activationListener()
+		if err != nil {
+			log.Fatalln("Failed to use the socket passed by the service manager:", err)
+		}
+		for _, value := range certFlags {
+			cert, err := parseCertFlag(value)
+			if err != nil {
+				log.Fatalln("Failed to load certificate:", err)
+			}
+			a.certs = append(a.certs, cert)
+		}
+		if len(a.certs) > 0 {
+			if err := a.checkCertificates(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		if l == nil && len(socketPaths) == 0 && *brokerFlag == "" {
+			flag.Usage()
+			os.Exit(1)
+		}
+		var listeners []agentListener
+		if l != nil {
+			if len(socketPaths) > 0 {
+				log.Println("Using the socket passed by the service manager, ignoring -l.")
+			}
+			listeners = append(listeners, agentListener{Listener: l})
+		} else {
+			for _, path := range socketPaths {
+				if strings.HasPrefix(path, tcpPrefix) {
+					if !*allowTCPFlag {
+						log.Fatalln("Listening on TCP exposes the agent to all local users, pass -allow-tcp to do it anyway.")
+					}
+					l, err := listenTCP(strings.TrimPrefix(path, tcpPrefix), *allowRemoteTCPFlag)
+					if err != nil {
+						log.Fatalln("Failed to listen:", err)
+					}
+					listeners = append(listeners, agentListener{Listener: l})
+					continue
+				}
+				if name, ok := abstractSocketName(path); ok {
+					l, err := listenAbstract(name)
+					if err != nil {
+						log.Fatalln("Failed to listen:", err)
+					}
+					listeners = append(listeners, agentListener{Listener: l})
+					continue
+				}
+				path = strings.TrimPrefix(path, unixPrefix)
+				l, err := listen(path)
+				if err != nil {
+					log.Fatalln("Failed to listen:", err)
+				}
+				listeners = append(listeners, agentListener{Listener: l, path: path})
+			}
+		}
+		if *brokerFlag != "" {
+			if runtime.GOOS == "windows" {
+				log.Fatalln("-broker is not supported on Windows.")
+			}
+			l, err := listen(*brokerFlag)
+			if err != nil {
+				log.Fatalln("Failed to listen for broker connections:", err)
+			}
+			listeners = append(listeners, agentListener{Listener: l, path: *brokerFlag, broker: true})
+		}
+		if *metricsAddrFlag != "" {
+			l, err := listenTCP(*metricsAddrFlag, *allowRemoteTCPFlag)
+			if err != nil {
+				log.Fatalln("Failed to listen for metrics:", err)
+			}
+			go a.serveMetrics(l)
+		}
+		if *hotplugFlag > 0 && a.mock == nil {
+			go a.watchCards(*hotplugFlag)
+		}
+		if a.keepalive > 0 {
+			go a.keepYKsAlive()
+		}
+		if *pidfileFlag != "" {
+			pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+			if err := ioutil.WriteFile(*pidfileFlag, pid, 0644); err != nil {
+				log.Fatalln("Failed to write the PID file:", err)
+			}
+			defer os.Remove(*pidfileFlag)
+		}
+		runAgent(listeners, a, reload)
+	}
+}
+
+// stringsFlag is a flag.Value that can be repeated to collect multiple values.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// runPrintKey prints the public key in slot for each connected YubiKey, in
+// authorized_keys format.
+func runPrintKey(a *Agent, slot piv.Slot, format string) {
+	if err := a.ensureYK(); err != nil {
+		log.Fatalln("Failed to connect to the YubiKey:", err)
+	}
+	defer a.closeYKs()
+	for _, yk := range a.yks {
+		pk, err := getPublicKey(yk.pivDevice, slot)
+		if errors.Is(err, ErrEmptySlot) {
+			log.Fatalf("YubiKey #%d has no key in PIV slot %s, set one up with -setup or -generate.", yk.serial, slotName(slot))
+		}
+		if err != nil {
+			log.Fatalf("Failed to read the key in YubiKey #%d PIV slot %s: %v", yk.serial, slotName(slot), err)
+		}
+		out, err := formatPublicKey(pk, format, a.keyComment(yk, slot))
+		if err != nil {
+			log.Fatalf("Failed to encode the key in YubiKey #%d PIV slot %s: %v", yk.serial, slotName(slot), err)
+		}
+		fmt.Println(out)
+	}
+}
+
+// agentListener is a listener the agent serves on. If path is not empty, it's
+// the socket file to remove on exit.
+type agentListener struct {
+	net.Listener
+	path string
+
+	// broker is set for the -broker control socket, which doesn't serve the
+	// agent protocol.
+	broker bool
+
+	// stop, if not nil, stops serving just this listener, which was opened
+	// through the broker, when closed. Otherwise, it's runAgent's done.
+	stop chan struct{}
+}
+
+// runAgent serves the agent on all listeners until SIGINT or SIGTERM.
+func runAgent(listeners []agentListener, a *Agent, reload func()) {
+	if !a.noPinentry {
+		if _, err := exec.LookPath(pinentryBinary); err != nil {
+			log.Fatalf("PIN entry program %q not found!", pinentryBinary)
+		}
+	}
+
+	// With -no-pinentry, running in a terminal is expected.
+	if terminal.IsTerminal(int(os.Stdin.Fd())) && !a.noPinentry {
+		log.Println("Warning: yubikey-agent is meant to run as a background daemon.")
+		log.Println("Running multiple instances is likely to lead to conflicts.")
+		log.Println("Consider using the launchd or systemd services.")
+	}
+
+	// Print a shell snippet for interactive launches, but keep the output of
+	// services clean, where the path is only logged.
+	if terminal.IsTerminal(int(os.Stdout.Fd())) {
+		fmt.Fprintln(os.Stderr, a.banner())
+	}
+	exported := false
+	for _, l := range listeners {
+		addr := l.Addr()
+		if l.broker {
+			logEvent("info", "listen", "Listening for broker connections", logFields{
+				"address": l.path,
+			})
+			continue
+		}
+		if addr.Network() == "unix" && !exported && terminal.IsTerminal(int(os.Stdout.Fd())) {
+			fmt.Printf("export SSH_AUTH_SOCK=%s\n", shellQuote(addr.String()))
+			exported = true
+			continue
+		}
+		logEvent("info", "listen", "Listening for agent connections", logFields{
+			"network": addr.Network(),
+			"address": addr.String(),
+		})
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			log.Println("Received SIGHUP, reloading the configuration and dropping YubiKey transactions...")
+			reload()
+			a.Close()
+		}
+	}()
+
+	// On SIGINT or SIGTERM, stop accepting connections and clean up, so that
+	// no stale socket is left behind. mu guards listeners, which can grow if
+	// sockets are recreated, and the closing of done.
+	var mu sync.Mutex
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-shutdown:
+			log.Printf("Received %v, shutting down...", sig)
+		case <-a.onceDone:
+			log.Println("Made the -once signature, shutting down...")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		close(done)
+		for _, l := range listeners {
+			if l.stop != nil {
+				close(l.stop)
+			}
+			l.Close()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var broker brokerControl
+	serve := func(l agentListener) {
+		handle, stop := a.serveConn, done
+		if l.broker {
+			handle = broker.serveBrokerConn
+		}
+		if l.stop != nil {
+			stop = l.stop
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveListener(l, stop, handle)
+		}()
+	}
+	// The broker adds and removes listeners under mu, like the recreation of
+	// removed sockets below, and can't add any after shutting down.
+	broker.open = func(path string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		select {
+		case <-done:
+			return errors.New("the agent is shutting down")
+		default:
+		}
+		for _, l := range listeners {
+			if l.path == path {
+				return fmt.Errorf("already listening on %s", path)
+			}
+		}
+		nl, err := listen(path)
+		if err != nil {
+			return err
+		}
+		logEvent("info", "listen", "Listening for agent connections, as requested through the broker", logFields{
+			"network": "unix",
+			"address": path,
+		})
+		l := agentListener{Listener: nl, path: path, stop: make(chan struct{})}
+		listeners = append(listeners, l)
+		serve(l)
+		return nil
+	}
+	broker.close = func(path string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		var kept []agentListener
+		found := false
+		for _, l := range listeners {
+			if l.path != path || l.stop == nil {
+				kept = append(kept, l)
+				continue
+			}
+			found = true
+			close(l.stop)
+			l.Close()
+		}
+		if !found {
+			return fmt.Errorf("no socket at %s was opened through the broker", path)
+		}
+		listeners = kept
+		os.Remove(path)
+		logEvent("info", "listen", "Stopped listening for agent connections, as requested through the broker", logFields{
+			"address": path,
+		})
+		return nil
+	}
+	for _, l := range listeners {
+		serve(l)
+	}
+
+	// Recreate sockets removed while the agent is running, for example by a
+	// /tmp cleaner, as clients can't reach the agent otherwise. The old
+	// listener is kept open, and closed on shutdown.
+	go func() {
+		for range time.Tick(socketCheckInterval) {
+			mu.Lock()
+			select {
+			case <-done:
+				mu.Unlock()
+				return
+			default:
+			}
+			for _, l := range listeners {
+				if l.path == "" || l.Addr().Network() != "unix" {
+					continue
+				}
+				if _, err := os.Stat(l.path); !os.IsNotExist(err) {
+					continue
+				}
+				nl, err := listen(l.path)
+				if err != nil {
+					log.Println("Failed to recreate the removed socket:", err)
+					continue
+				}
+				logEvent("info", "listen", "Recreated the removed socket", logFields{
+					"address": l.path,
+				})
+				rl := agentListener{Listener: nl, path: l.path, broker: l.broker}
+				if l.stop != nil {
+					rl.stop = make(chan struct{})
+				}
+				listeners = append(listeners, rl)
+				serve(rl)
+			}
+			mu.Unlock()
+		}
+	}()
+
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	for _, l := range listeners {
+		if l.path != "" {
+			os.Remove(l.path)
+		}
+	}
+	a.Close()
+}
+
+// socketCheckInterval is how often runAgent checks that the sockets it's
+// listening on still exist.
+const socketCheckInterval = 10 * time.Second
+
+// banner returns a line describing the agent version, and the connected
+// YubiKeys and their keys, for interactive launches. Not finding a YubiKey is
+// not an error at startup, so it only tries to connect once.
+func (a *Agent) banner() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	line := "yubikey-agent " + Version
+	if len(a.yks) == 0 {
+		yks, err := a.connectToYKs()
+		if err != nil {
+			return line + ", no YubiKey connected yet (" + err.Error() + ")"
+		}
+		a.setYKs(yks)
+		a.resetIdleTimer()
+	}
+	keys, _ := a.slotKeys()
+	for _, yk := range a.yks {
+		line += fmt.Sprintf(", YubiKey #%d (firmware %s)", yk.serial, versionString(yk.Version()))
+		n := 0
+		for _, k := range keys {
+			if k.yk == yk {
+				line += fmt.Sprintf(" %s %s", slotName(k.slot), ssh.FingerprintSHA256(k.pk))
+				n++
+			}
+		}
+		if n == 0 {
+			line += " with no keys"
+		}
+	}
+	return line
+}
+
+// shellQuote quotes s for a POSIX shell, if it contains special characters.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789/._-+:@%", r)
+	}) == -1 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// serveListener accepts connections on l, and passes them to handle, until
+// done is closed.
+func serveListener(l net.Listener, done <-chan struct{}, handle func(net.Conn)) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			type temporary interface {
+				Temporary() bool
+			}
+			if err, ok := err.(temporary); ok && err.Temporary() {
+				log.Println("Temporary Accept error, sleeping 1s:", err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+			log.Fatalln("Failed to accept connections:", err)
+		}
+		go handle(c)
+	}
+}
+
+type Agent struct {
+	// signatures counts the signatures produced since startup, and
+	// signatureErrors, pinPrompts, and reconnects are exposed by -metrics-addr.
+	// They are accessed atomically, and are first in the struct to be 64-bit
+	// aligned.
+	signatures      uint64
+	signatureErrors uint64
+	pinPrompts      uint64
+	reconnects      uint64
+	// connected holds the []uint32 serial numbers of the open YubiKeys, for
+	// -metrics-addr to read without waiting for a.mu.
+	connected atomic.Value
+	// onceUsed is set to 1 atomically when the -once signature is reserved.
+	onceUsed uint32
+	// started is when the agent started, and is only set at construction.
+	started time.Time
+	// once, from -once, makes the agent exit after a single signature, when
+	// the connection that requested it ends, by closing onceDone. Both are
+	// only set at construction.
+	once     bool
+	onceDone chan struct{}
+
+	// mu guards all the fields below, and is held for the whole duration of
+	// every operation that talks to the YubiKeys, since PC/SC transactions
+	// can't be used concurrently. This serializes signatures across all
+	// connections, which is fine since the hardware can only do one at a time
+	// anyway, and most of them wait for a touch.
+	mu  sync.Mutex
+	yks []*yubiKey
+
+	// slots are the PIV slots to search for keys, usually allSlots except
+	// for 9d, see -enable-9d.
+	slots []piv.Slot
+
+	// wantSerial, if not zero, is the serial number of the YubiKey to use when
+	// more than one is connected. Otherwise, all connected YubiKeys are used.
+	wantSerial uint32
+
+	// idleTimeout, if not zero, is how long the YubiKeys are kept open after
+	// the last request, after which idleTimer closes them to let other
+	// applications use them.
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+
+	// keepalive, if not zero, is the interval at which keepYKsAlive checks
+	// the YubiKeys, from -keepalive. Requests within keepalive of the last
+	// successful check, at lastHealthy, skip it. keepalive is only set at
+	// construction.
+	keepalive   time.Duration
+	lastHealthy time.Time
+
+	// pcscFailures counts the consecutive PC/SC failures, see pcscFailed.
+	pcscFailures int
+
+	// reader, if set, selects the smart cards to use by reader name, from
+	// -reader, see selectCards.
+	reader string
+
+	// waitForKey, if not zero, is how long ensureYK waits for a YubiKey to be
+	// plugged in if there is none, instead of failing right away.
+	waitForKey time.Duration
+
+	// pinCacheTTL, if not zero, is how long a PIN is kept in pins after being
+	// entered, to avoid prompting again when the YubiKey forgets it.
+	pinCacheTTL time.Duration
+	pins        map[uint32]*cachedPIN
+
+	// keychain, if not nil, is where getPIN looks for the PIN before asking
+	// for it, and where it stores it after, for -pin-keychain.
+	keychain keychain
+
+	// locked is set by Lock, which also stores a hash of the passphrase in
+	// lockHash for Unlock to check.
+	locked   bool
+	lockHash [sha256.Size]byte
+
+	// destinations, if not nil, are the only hops signatures can be made for
+	// through session-bound connections, from -destination.
+	destinations []destinationConstraint
+
+	// allowedKeys, if not empty, is the set of SHA256 fingerprints of the only
+	// keys to offer, from -allow-key.
+	allowedKeys map[string]bool
+
+	// mock, if not nil, is the simulated YubiKey used instead of the smart
+	// cards, with -mock. It's only set at construction.
+	mock *mockYubiKey
+
+	// allowedUIDs, if not nil, are the only users that can connect to UNIX
+	// sockets: the owner, and those added with -allow-uid. It's only set at
+	// construction.
+	allowedUIDs map[uint32]bool
+
+	// peerRules, if not empty, restrict the slots each client can use based
+	// on its user and groups, from -peer-slots. Clients that don't match any
+	// rule can't use any key.
+	peerRules []peerRule
+
+	// noAttestCheck disables the attestation check of the keys, see
+	// yubiKey.verifyKey.
+	noAttestCheck bool
+
+	// allowRegenerate enables the regenerate@yubikey-agent extension.
+	allowRegenerate bool
+
+	// noPinentry makes getPIN read the PIN from stdin instead of pinentry.
+	noPinentry bool
+
+	// audit, if not nil, is the -audit-log file.
+	audit *auditLog
+
+	// pinHelperSocket, if set, is the -pin-helper-socket that getPIN asks
+	// for the PIN, instead of askpass or pinentry.
+	pinHelperSocket string
+
+	// askpass, if set, is the SSH_ASKPASS style program used by getPIN
+	// instead of pinentry, from -askpass or $SSH_ASKPASS.
+	askpass string
+
+	// noSHA1 makes RSA keys never produce SHA-1 signatures.
+	noSHA1 bool
+
+	// comment is the -comment template for the key comments, if any.
+	comment *template.Template
+
+	// prefer are the SSH key types to list first, in order, from -prefer.
+	prefer []string
+
+	// certs are SSH certificates offered alongside the keys they certify.
+	certs []certificate
+
+	// confirm requires each signature to be confirmed with pinentry.
+	confirm bool
+
+	// requireTouch requires signatures with keys that the YubiKey doesn't
+	// require to be touched to be confirmed with pinentry instead.
+	requireTouch bool
+
+	// notifier, if not nil, is used to show a notification while waiting for
+	// the YubiKey to be touched.
+	notifier notifier
+
+	// touchNotification is armed by Sign to show a notification if waiting for
+	// more than touchDelay for the touch operation. It is paused and reset
+	// by getPIN so it won't fire while waiting for the PIN. touchCancel stops
+	// it, and dismisses the notification if it was shown.
+	touchNotification *time.Timer
+	touchDelay        time.Duration
+	touchCancel       context.CancelFunc
+
+	// maxSignsPerMinute, if not zero, limits the rate of signatures, with a
+	// token bucket of that size, refilled continuously. signTokens is the
+	// number of tokens left at signTokensTime.
+	maxSignsPerMinute int
+	signTokens        float64
+	signTokensTime    time.Time
+
+	// signTimeout, if not zero, is how long sign waits for a signature before
+	// failing. signTimer counts it down during a signature, and like
+	// touchNotification is paused while waiting for the user to enter the PIN.
+	signTimeout time.Duration
+	signTimer   *time.Timer
+}
+
+// pivDevice is the part of *piv.YubiKey that the agent uses, so that it can
+// also run against the simulated YubiKey of -mock.
+type pivDevice interface {
+	Close() error
+	Version() piv.Version
+	Serial() (uint32, error)
+	Retries() (int, error)
+	Reset() error
+	AttestationCertificate() (*x509.Certificate, error)
+	Attest(slot piv.Slot) (*x509.Certificate, error)
+	Certificate(slot piv.Slot) (*x509.Certificate, error)
+	SetCertificate(key [24]byte, slot piv.Slot, cert *x509.Certificate) error
+	GenerateKey(key [24]byte, slot piv.Slot, opts piv.Key) (crypto.PublicKey, error)
+	PrivateKey(slot piv.Slot, public crypto.PublicKey, auth piv.KeyAuth) (crypto.PrivateKey, error)
+	Metadata(pin string) (*piv.Metadata, error)
+}
+
+// yubiKey is a connected YubiKey.
+type yubiKey struct {
+	pivDevice
+
+	// serial is cached locally because requesting it on older firmwares
+	// requires switching application, which drops the PIN cache.
+	serial uint32
+
+	// attestationCert is the raw attestation certificate of the YubiKey when
+	// it was opened, which healthy uses to check it wasn't replaced.
+	attestationCert []byte
+
+	// wrongPIN is set when the last PIN entered was incorrect, so that getPIN
+	// can point it out when asking again.
+	wrongPIN bool
+
+	// verified maps slots to the public keys that passed verifyKey.
+	verified map[piv.Slot][]byte
+
+	// attestations caches the results of attestation.
+	attestations map[piv.Slot]*piv.Attestation
+
+	// keys caches the results of publicKey, with nil for empty slots, and
+	// signers the results of Agent.signer. The YubiKey is held exclusively
+	// while open, so the slots can't change until it's reopened, which
+	// starts with empty caches, except through forgetSlot.
+	keys    map[piv.Slot]ssh.PublicKey
+	signers map[piv.Slot]ssh.Signer
+}
+
+// forgetSlot drops everything cached about slot, after its key is replaced.
+func (yk *yubiKey) forgetSlot(slot piv.Slot) {
+	delete(yk.keys, slot)
+	delete(yk.signers, slot)
+	delete(yk.verified, slot)
+	delete(yk.attestations, slot)
+}
+
+// publicKey returns the public key in slot, like getPublicKey, but caches it
+// until the YubiKey is reconnected.
+func (yk *yubiKey) publicKey(slot piv.Slot) (ssh.PublicKey, error) {
+	if pk, ok := yk.keys[slot]; ok {
+		if pk == nil {
+			return nil, fmt.Errorf("%w %s", ErrEmptySlot, slotName(slot))
+		}
+		return pk, nil
+	}
+	pk, err := getPublicKey(yk.pivDevice, slot)
+	if err != nil && !errors.Is(err, ErrEmptySlot) {
+		return nil, err
+	}
+	if yk.keys == nil {
+		yk.keys = make(map[piv.Slot]ssh.PublicKey)
+	}
+	yk.keys[slot] = pk
+	return pk, err
+}
+
+var _ agent.Agent = &Agent{}
+
+func (a *Agent) serveConn(c net.Conn) {
+	peer := peerFields(c)
+	logEvent("debug", "connect", "Agent client connected", peer)
+	if a.allowedUIDs != nil {
+		// Other connections, like TCP, can't be checked, and were opted into.
+		if uid, _, err := peerIDs(c); err == nil && !a.allowedUIDs[uid] {
+			logEvent("warning", "reject", "Rejected a connection from a user not allowed by -allow-uid", peer)
+			c.Close()
+			return
+		}
+	}
+	ca := &connAgent{Agent: a, peer: peer}
+	// Clients that can't be identified, like over TCP, were opted into.
+	if uid, _, err := peerIDs(c); err == nil && uid != uint32(os.Getuid()) {
+		ca.foreign = true
+	}
+	if len(a.peerRules) > 0 {
+		ca.slots = a.peerSlots(c)
+	}
+	if err := agent.ServeAgent(ca, c); err != io.EOF {
+		fields := logFields{"error": err.Error()}
+		for k, v := range peer {
+			fields[k] = v
+		}
+		logEvent("error", "error", "Agent client connection ended with error", fields)
+	}
+	if ca.signed {
+		// Only one connection can sign with -once, so this happens once.
+		close(a.onceDone)
+	}
+}
+
+// healthy reports whether yk is still responding, and is still the same
+// YubiKey that was opened, and not another one plugged into the same reader,
+// like a dock or a slot of a multi-card reader.
+func healthy(yk *yubiKey) bool {
+	// We can't use Serial on older firmwares because it locks the session, and
+	// can't use Retries because it fails when the session is unlocked. The
+	// attestation certificate is unique to each YubiKey.
+	cert, err := yk.AttestationCertificate()
+	if err != nil {
+		return false
+	}
+	if yk.attestationCert != nil && !bytes.Equal(cert.Raw, yk.attestationCert) {
+		logEvent("warning", "reconnect", "A different YubiKey is plugged in", logFields{
+			"serial": yk.serial,
+		})
+		return false
+	}
+	if v := yk.Version(); v.Major >= 5 {
+		if serial, err := yk.Serial(); err != nil || serial != yk.serial {
+			logEvent("warning", "reconnect", "The YubiKey serial number changed", logFields{
+				"serial": yk.serial,
+			})
+			return false
+		}
+	}
+	return true
+}
+
+// ensureYK connects to the YubiKeys, or reconnects if any of them is not
+// responding. It must be called with a.mu held.
+func (a *Agent) ensureYK() error {
+	a.resetIdleTimer()
+	if len(a.yks) > 0 && a.keepalive > 0 && time.Since(a.lastHealthy) < a.keepalive {
+		return nil
+	}
+	if len(a.yks) > 0 && a.allHealthy() {
+		a.lastHealthy = time.Now()
+		return nil
+	}
+	if len(a.yks) > 0 {
+		log.Println("Reconnecting to the YubiKeys...")
+		atomic.AddUint64(&a.reconnects, 1)
+		a.closeYKs()
+	} else {
+		log.Println("Connecting to the YubiKeys...")
+	}
+	// Retry for a little while, so that a brief unplug, or a request that
+	// races with the YubiKey coming back, doesn't fail.
+	const attempts = 3
+	for i := 1; ; i++ {
+		yks, err := a.connectToYKs()
+		if err == nil {
+			a.setYKs(yks)
+			return nil
+		}
+		if i == attempts && errors.Is(err, ErrNoYubiKey) && a.waitForKey > 0 {
+			return a.waitForYK()
+		}
+		if i == attempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+		}
+		log.Println("Failed to connect to the YubiKeys, retrying in 1s:", err)
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// resetIdleTimer restarts the -idle-timeout countdown, at the end of which the
+// YubiKeys are closed, to be reopened by the next ensureYK. It must be called
+// with a.mu held.
+func (a *Agent) resetIdleTimer() {
+	if a.idleTimeout == 0 {
+		return
+	}
+	if a.idleTimer != nil {
+		a.idleTimer.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(a.idleTimeout, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.idleTimer != t {
+			// The timer was reset while this was waiting for the lock.
+			return
+		}
+		a.idleTimer = nil
+		if len(a.yks) > 0 {
+			log.Println("Closing the idle YubiKeys...")
+			a.closeYKs()
+		}
+	})
+	a.idleTimer = t
+}
+
+// yubiKey returns the connected YubiKey with the given serial number, or the
+// only connected one if serial is zero.
+func (a *Agent) yubiKey(serial uint32) (*yubiKey, error) {
+	if serial == 0 {
+		if len(a.yks) != 1 {
+			return nil, fmt.Errorf("%d YubiKeys connected, a serial number is required", len(a.yks))
+		}
+		return a.yks[0], nil
+	}
+	for _, yk := range a.yks {
+		if yk.serial == serial {
+			return yk, nil
+		}
+	}
+	return nil, fmt.Errorf("YubiKey #%d not connected", serial)
+}
+
+func (a *Agent) allHealthy() bool {
+	for _, yk := range a.yks {
+		if !healthy(yk) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *Agent) closeYKs() error {
+	var err error
+	for _, yk := range a.yks {
+		if e := yk.Close(); e != nil {
+			err = e
+		}
+	}
+	a.setYKs(nil)
+	return err
+}
+
+// setYKs replaces the open YubiKeys. It must be called with a.mu held.
+func (a *Agent) setYKs(yks []*yubiKey) {
+	a.yks = yks
+	var serials []uint32
+	for _, yk := range yks {
+		serials = append(serials, yk.serial)
+	}
+	a.connected.Store(serials)
+}
+
+// selectCards returns the smart cards to use. If reader is set, those are the
+// ones whose reader name contains it. Otherwise, they are the YubiKeys, as
+// recognized by their reader name, or all cards if none looks like one, so
+// that other smart card readers, like those built into some laptops, are
+// skipped. Matches are case-insensitive.
+func selectCards(cards []string, reader string) []string {
+	var selected []string
+	for _, card := range cards {
+		name := strings.ToLower(card)
+		if reader != "" && strings.Contains(name, strings.ToLower(reader)) ||
+			reader == "" && (strings.Contains(name, "yubikey") || strings.Contains(name, "yubico")) {
+			selected = append(selected, card)
+		}
+	}
+	if reader == "" && len(selected) == 0 {
+		return cards
+	}
+	return selected
+}
+
+// ErrNoYubiKey is returned when no YubiKey is plugged in, as opposed to
+// ErrEmptySlot, when a YubiKey is plugged in but the slot has no key.
+var ErrNoYubiKey = errors.New("no YubiKey detected")
+
+// waitForYK waits up to waitForKey for a YubiKey to be plugged in, and
+// connects to it. It must be called with a.mu held.
+func (a *Agent) waitForYK() error {
+	logEvent("info", "wait", "Waiting for a YubiKey to be plugged in...", logFields{
+		"timeout": a.waitForKey.String(),
+	})
+	deadline := time.Now().Add(a.waitForKey)
+	for {
+		yks, err := a.connectToYKs()
+		if err == nil {
+			a.setYKs(yks)
+			log.Println("YubiKey plugged in, connected.")
+			return nil
+		}
+		if !errors.Is(err, ErrNoYubiKey) || time.Now().After(deadline) {
+			return fmt.Errorf("gave up waiting for a YubiKey after %v: %w", a.waitForKey, err)
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// connectToYKs opens all connected YubiKeys, or only the one matching
+// wantSerial if set, or the simulated one with -mock.
+func (a *Agent) connectToYKs() ([]*yubiKey, error) {
+	if a.mock != nil {
+		return a.connectToMock()
+	}
+	defer warnSlowPCSC()()
+	cards, err := piv.Cards()
+	if err != nil {
+		return nil, a.pcscFailed(err)
+	}
+	cards = selectCards(cards, a.reader)
+	if len(cards) == 0 {
+		a.pcscSucceeded()
+		return nil, ErrNoYubiKey
+	}
+	return a.openCards(cards, func(card string) (pivDevice, error) {
+		yk, err := piv.Open(card)
+		if err != nil {
+			return nil, err
+		}
+		return yk, nil
+	})
+}
+
+// openCards opens the smart cards in the named readers with open, and returns
+// the YubiKeys selected by wantSerial, or all of them if it's not set.
+func (a *Agent) openCards(cards []string, open func(card string) (pivDevice, error)) ([]*yubiKey, error) {
+	var yks []*yubiKey
+	var seen, matched []string
+	var lastErr error
+	opened := false
+	for _, card := range cards {
+		yk, err := open(card)
+		if err != nil {
+			err = explainOpenError(err)
+			seen = append(seen, fmt.Sprintf("%q (%v)", card, err))
+			lastErr = err
+			continue
+		}
+		opened = true
+		serial, _ := yk.Serial()
+		if a.wantSerial != 0 && serial != a.wantSerial {
+			yk.Close()
+			seen = append(seen, fmt.Sprintf("#%d", serial))
+			continue
+		}
+		matched = append(matched, fmt.Sprintf("%q", card))
+		y := &yubiKey{pivDevice: yk, serial: serial}
+		if cert, err := yk.AttestationCertificate(); err == nil {
+			y.attestationCert = cert.Raw
+		}
+		yks = append(yks, y)
+		warnFirmware(y)
+		warnBlockedPIN(y)
+	}
+	if opened {
+		a.pcscSucceeded()
+	}
+	if len(yks) > 1 && a.wantSerial != 0 {
+		// Serial numbers should be unique, but never pick one arbitrarily.
+		for _, yk := range yks {
+			yk.Close()
+		}
+		return nil, fmt.Errorf("%d YubiKeys with serial number %d detected, refusing to pick one: %s",
+			len(yks), a.wantSerial, strings.Join(matched, ", "))
+	}
+	if len(yks) == 0 && a.wantSerial != 0 {
+		return nil, fmt.Errorf("no YubiKey with serial number %d detected, found: %s",
+			a.wantSerial, strings.Join(seen, ", "))
+	}
+	if len(yks) == 0 {
+		if !errors.Is(lastErr, errInUse) {
+			return nil, a.pcscFailed(lastErr)
+		}
+		return nil, lastErr
+	}
+	return yks, nil
+}
+
+// errInUse is returned when the YubiKey can't be opened because another
+// application is connected to it.
+var errInUse = errors.New("the YubiKey is being used by another application, like a browser or ykman; close it and retry")
+
+// explainOpenError translates the opaque PC/SC error returned by piv.Open when
+// another application holds the card into errInUse. The piv package doesn't
+// export its error type, so this matches the SCARD_E_SHARING_VIOLATION message.
+func explainOpenError(err error) error {
+	const sharingViolation = "the smart card cannot be accessed because of other connections outstanding"
+	if strings.Contains(err.Error(), sharingViolation) {
+		return fmt.Errorf("%w (%v)", errInUse, err)
+	}
+	return err
+}
+
+// warnBlockedPIN logs a warning if the PIN of yk is blocked, in which case all
+// signatures would fail. piv-go can't read the PUK retries, so the warning
+// covers both cases.
+func warnBlockedPIN(yk *yubiKey) {
+	retries, err := yk.Retries()
+	if err != nil || retries > 0 {
+		return
+	}
+	logEvent("error", "pin-blocked", "The PIN is blocked after too many incorrect attempts. "+
+		"Unblock it with the PUK using \"ykman piv access unblock-pin\". If the PUK is blocked too, "+
+		"the keys are lost, and the YubiKey can only be reset with \"yubikey-agent -reset\".", logFields{
+		"serial": yk.serial,
+	})
+}
+
+func (a *Agent) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.forgetPINs()
+	return a.closeYKs()
+}
+
+// getPIN returns the PIN of yk, from the cache or by asking the user. If
+// noCache is set, the user is always asked, and the PIN is not cached. The
+// caller should zero the returned buffer once it's done with it.
+func (a *Agent) getPIN(yk *yubiKey, noCache bool) ([]byte, error) {
+	if c, ok := a.pins[yk.serial]; ok && !noCache {
+		return append([]byte(nil), c.pin...), nil
+	}
+	if a.keychain != nil && !noCache && !yk.wrongPIN {
+		pin, err := a.keychain.load(yk.serial)
+		if err != nil {
+			log.Println(err)
+		} else if pin != nil {
+			return pin, nil
+		}
+	}
+	atomic.AddUint64(&a.pinPrompts, 1)
+	if a.touchNotification != nil && a.touchNotification.Stop() {
+		defer a.touchNotification.Reset(a.touchDelay)
+	}
+	if a.signTimer != nil && a.signTimer.Stop() {
+		defer a.signTimer.Reset(a.signTimeout)
+	}
+	var retries, errMsg string
+	if r, err := yk.Retries(); err == nil {
+		retries = fmt.Sprintf(" (%d tries remaining)", r)
+		if yk.wrongPIN {
+			errMsg = fmt.Sprintf("Incorrect PIN, %d tries remaining", r)
+		}
+	}
+	yk.wrongPIN = false
+	desc := fmt.Sprintf("YubiKey serial number: %d"+retries, yk.serial)
+
+	var pin []byte
+	var err error
+	if a.pinHelperSocket != "" {
+		pin, err = readPINFromHelper(a.pinHelperSocket, yk.serial, desc, errMsg)
+	} else if a.askpass != "" {
+		pin, err = readPINWithAskpass(a.askpass, desc, errMsg)
+	} else if a.noPinentry {
+		pin, err = readPINFromStdin(desc, errMsg)
+	} else {
+		pin, err = readPINWithPinentry(yk, desc, errMsg, noCache)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if a.pinCacheTTL > 0 && !noCache {
+		a.cachePIN(yk.serial, pin)
+	}
+	if a.keychain != nil && !noCache {
+		// If the PIN is wrong, sign removes it again.
+		if err := a.keychain.store(yk.serial, pin); err != nil {
+			log.Println(err)
+		}
+	}
+	return pin, nil
+}
+
+func readPINWithPinentry(yk *yubiKey, desc, errMsg string, noCache bool) ([]byte, error) {
+	p, err := newPinentry()
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+	p.set("title", "yubikey-agent PIN Prompt")
+	if errMsg != "" {
+		p.set("error", errMsg)
+	}
+	p.set("desc", desc)
+	p.set("prompt", "Please enter your PIN:")
+
+	// Enable opt-in external PIN caching (in the OS keychain).
+	// https://gist.github.com/mdeguzis/05d1f284f931223624834788da045c65#file-info-pinentry-L324
+	if !noCache {
+		p.command("OPTION allow-external-password-cache")
+		p.set("KEYINFO", fmt.Sprintf("--yubikey-id-%d", yk.serial))
+	}
+
+	return p.command("GETPIN")
+}
+
+// readPINWithAskpass reads a PIN by running an SSH_ASKPASS style program,
+// which gets the prompt as its argument and prints the PIN on stdout.
+func readPINWithAskpass(program, desc, errMsg string) ([]byte, error) {
+	prompt := desc + "\nPlease enter your PIN:"
+	if errMsg != "" {
+		prompt = errMsg + "\n" + prompt
+	}
+	cmd := exec.Command(program, prompt)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		zeroBytes(out)
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil, errors.New("PIN entry canceled")
+		}
+		return nil, fmt.Errorf("failed to run askpass program: %w", err)
+	}
+	return bytes.TrimRight(out, "\r\n"), nil
+}
+
+// defaultAskpass returns the askpass program from $SSH_ASKPASS if OpenSSH
+// would prefer it to the terminal, that is if $SSH_ASKPASS_REQUIRE is
+// "prefer" or "force", and otherwise "".
+func defaultAskpass() string {
+	switch os.Getenv("SSH_ASKPASS_REQUIRE") {
+	case "prefer", "force":
+		return os.Getenv("SSH_ASKPASS")
 	}
+	return ""
+}
 
-	socketPath := flag.String("l", "", "agent: path of the UNIX socket to listen on")
-	resetFlag := flag.Bool("really-delete-all-piv-keys", false, "setup: reset the PIV applet")
-	setupFlag := flag.Bool("setup", false, "setup: configure a new YubiKey")
-	flag.Parse()
+// stdinPINs buffers stdin for -no-pinentry when it's not a terminal, in which
+// case a PIN is read from each line.
+var stdinPINs = bufio.NewReader(os.Stdin)
 
-	if flag.NArg() > 0 {
-		flag.Usage()
-		os.Exit(1)
+// readPINFromStdin reads a PIN for -no-pinentry, prompting on the terminal if
+// stdin is one, and otherwise reading a line from stdin.
+func readPINFromStdin(desc, errMsg string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		line, err := stdinPINs.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			zeroBytes(line)
+			return nil, fmt.Errorf("failed to read the PIN from stdin: %w", err)
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
 	}
+	if errMsg != "" {
+		fmt.Fprintln(os.Stderr, errMsg)
+	}
+	fmt.Fprintf(os.Stderr, "%s\nPlease enter your PIN: ", desc)
+	defer fmt.Fprintln(os.Stderr)
+	return terminal.ReadPassword(fd)
+}
 
-	if *setupFlag {
-		log.SetFlags(0)
-		yk := connectForSetup()
-		if *resetFlag {
-			runReset(yk)
-		}
-		runSetup(yk)
-	} else {
-		if *socketPath == "" {
-			flag.Usage()
-			os.Exit(1)
+// cachedPIN is a PIN kept in memory for pinCacheTTL after it was entered.
+type cachedPIN struct {
+	pin   []byte
+	timer *time.Timer
+}
+
+func (a *Agent) cachePIN(serial uint32, pin []byte) {
+	a.forgetPIN(serial)
+	c := &cachedPIN{pin: append([]byte(nil), pin...)}
+	c.timer = time.AfterFunc(a.pinCacheTTL, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.pins[serial] == c {
+			a.forgetPIN(serial)
 		}
-		runAgent(*socketPath)
+	})
+	if a.pins == nil {
+		a.pins = make(map[uint32]*cachedPIN)
 	}
+	a.pins[serial] = c
 }
 
-func runAgent(socketPath string) {
-	if _, err := exec.LookPath(pinentry.GetBinary()); err != nil {
-		log.Fatalf("PIN entry program %q not found!", pinentry.GetBinary())
+// forgetPIN zeroes and removes the cached PIN for the YubiKey with the given
+// serial number, if any.
+func (a *Agent) forgetPIN(serial uint32) {
+	c, ok := a.pins[serial]
+	if !ok {
+		return
 	}
+	c.timer.Stop()
+	zeroBytes(c.pin)
+	delete(a.pins, serial)
+}
 
-	if terminal.IsTerminal(int(os.Stdin.Fd())) {
-		log.Println("Warning: yubikey-agent is meant to run as a background daemon.")
-		log.Println("Running multiple instances is likely to lead to conflicts.")
-		log.Println("Consider using the launchd or systemd services.")
+func (a *Agent) forgetPINs() {
+	for serial := range a.pins {
+		a.forgetPIN(serial)
 	}
+}
 
-	a := &Agent{}
+// zeroBytes overwrites b, to remove a PIN from memory once it's not needed.
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
 
-	c := make(chan os.Signal)
-	signal.Notify(c, syscall.SIGHUP)
-	go func() {
-		for range c {
-			a.Close()
-		}
-	}()
+// List returns the public keys in the YubiKeys, and their certificates. It
+// never needs the PIN: keys are read from the slot certificates or
+// attestations, and only signer, when signing, asks for the PIN. This must be
+// preserved, so that merely listing keys, like ssh does on every connection,
+// never shows a dialog.
+func (a *Agent) List() ([]*agent.Key, error) {
+	return a.list(nil)
+}
 
-	os.Remove(socketPath)
-	if err := os.MkdirAll(filepath.Dir(socketPath), 0777); err != nil {
-		log.Fatalln("Failed to create UNIX socket folder:", err)
+// list implements List. If slots is not nil, only keys in those slots are
+// returned.
+func (a *Agent) list(slots map[piv.Slot]bool) ([]*agent.Key, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return nil, ErrAgentLocked
 	}
-	l, err := net.Listen("unix", socketPath)
-	if err != nil {
-		log.Fatalln("Failed to listen on UNIX socket:", err)
+	if err := a.ensureYK(); err != nil {
+		return nil, fmt.Errorf("could not reach YubiKey: %w", err)
 	}
 
-	for {
-		c, err := l.Accept()
-		if err != nil {
-			type temporary interface {
-				Temporary() bool
-			}
-			if err, ok := err.(temporary); ok && err.Temporary() {
-				log.Println("Temporary Accept error, sleeping 1s:", err)
-				time.Sleep(1 * time.Second)
-				continue
-			}
-			log.Fatalln("Failed to accept connections:", err)
+	keys, err := a.slotKeys()
+	if err != nil {
+		return nil, err
+	}
+	a.sortPreferred(keys)
+	var list []*agent.Key
+	for _, k := range keys {
+		if slots != nil && !slots[k.slot] {
+			continue
+		}
+		list = append(list, &agent.Key{
+			Format:  k.pk.Type(),
+			Blob:    k.pk.Marshal(),
+			Comment: a.keyComment(k.yk, k.slot),
+		})
+		for _, cert := range a.certsForKey(k) {
+			list = append(list, &agent.Key{
+				Format:  cert.Type(),
+				Blob:    cert.Marshal(),
+				Comment: a.keyComment(k.yk, k.slot) + " Certificate",
+			})
 		}
-		go a.serveConn(c)
 	}
+	return list, nil
 }
 
-type Agent struct {
-	mu     sync.Mutex
-	yk     *piv.YubiKey
-	serial uint32
-
-	// touchNotification is armed by Sign to show a notification if waiting for
-	// more than a few seconds for the touch operation. It is paused and reset
-	// by getPIN so it won't fire while waiting for the PIN.
-	touchNotification *time.Timer
+// preferAliases are the short -prefer names, and the key types they match.
+var preferAliases = map[string][]string{
+	"ecdsa": {ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384},
+	"rsa":   {ssh.KeyAlgoRSA},
 }
 
-var _ agent.ExtendedAgent = &Agent{}
-
-func (a *Agent) serveConn(c net.Conn) {
-	if err := agent.ServeAgent(a, c); err != io.EOF {
-		log.Println("Agent client connection ended with error:", err)
+// parsePrefer parses a -prefer list, like "ecdsa,rsa", into SSH key types.
+func parsePrefer(value string) ([]string, error) {
+	var types []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+		case preferAliases[name] != nil:
+			types = append(types, preferAliases[name]...)
+		case name == ssh.KeyAlgoECDSA256 || name == ssh.KeyAlgoECDSA384:
+			types = append(types, name)
+		default:
+			return nil, fmt.Errorf("invalid -prefer algorithm %q, expected ecdsa, rsa, or an SSH key type", name)
+		}
 	}
+	return types, nil
 }
 
-func healthy(yk *piv.YubiKey) bool {
-	// We can't use Serial because it locks the session on older firmwares, and
-	// can't use Retries because it fails when the session is unlocked.
-	_, err := yk.AttestationCertificate()
-	return err == nil
+// sortPreferred sorts keys by the order of their types in a.prefer. Keys of
+// other types keep their order, after the preferred ones.
+func (a *Agent) sortPreferred(keys []slotKey) {
+	if len(a.prefer) == 0 {
+		return
+	}
+	rank := func(k slotKey) int {
+		for i, t := range a.prefer {
+			if k.pk.Type() == t {
+				return i
+			}
+		}
+		return len(a.prefer)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return rank(keys[i]) < rank(keys[j])
+	})
 }
 
-func (a *Agent) ensureYK() error {
-	if a.yk == nil || !healthy(a.yk) {
-		if a.yk != nil {
-			log.Println("Reconnecting to the YubiKey...")
-			a.yk.Close()
-		} else {
-			log.Println("Connecting to the YubiKey...")
-		}
-		yk, err := a.connectToYK()
-		if err != nil {
-			return err
-		}
-		a.yk = yk
+// allSlots are the PIV slots that can hold keys, in the order they are
+// offered to clients.
+var allSlots = append([]piv.Slot{
+	piv.SlotAuthentication,
+	piv.SlotSignature,
+	piv.SlotCardAuthentication,
+	piv.SlotKeyManagement,
+}, retiredSlots()...)
+
+// retiredSlots returns the 20 retired key management slots, 82 to 95.
+// See NIST SP 800-73-4, Part 1, Table 3 and Table 4b.
+func retiredSlots() []piv.Slot {
+	var s []piv.Slot
+	for i := uint32(0); i < 20; i++ {
+		s = append(s, piv.Slot{Key: 0x82 + i, Object: 0x5fc10d + i})
 	}
-	return nil
+	return s
 }
 
-func (a *Agent) connectToYK() (*piv.YubiKey, error) {
-	cards, err := piv.Cards()
+// commentData is the data passed to the -comment template.
+type commentData struct {
+	Serial uint32
+	Slot   string
+	// Touch is the touch policy of the key, like "always", or empty if it
+	// can't be attested.
+	Touch string
+}
+
+// parseCommentTemplate parses a -comment template, and checks that it can be
+// executed, so that mistakes are reported at startup.
+func parseCommentTemplate(text string) (*template.Template, error) {
+	t, err := template.New("comment").Parse(text)
 	if err != nil {
 		return nil, err
 	}
-	if len(cards) == 0 {
-		return nil, errors.New("no YubiKey detected")
-	}
-	// TODO: support multiple YubiKeys.
-	yk, err := piv.Open(cards[0])
-	if err != nil {
+	if err := t.Execute(ioutil.Discard, commentData{}); err != nil {
 		return nil, err
 	}
-	// Cache the serial number locally because requesting it on older firmwares
-	// requires switching application, which drops the PIN cache.
-	a.serial, _ = yk.Serial()
-	return yk, nil
+	return t, nil
 }
 
-func (a *Agent) Close() error {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	if a.yk != nil {
-		log.Println("Received SIGHUP, dropping YubiKey transaction...")
-		err := a.yk.Close()
-		a.yk = nil
-		return err
+// keyComment returns the comment of the key in slot, from the -comment
+// template if set.
+func (a *Agent) keyComment(yk *yubiKey, slot piv.Slot) string {
+	data := commentData{Serial: yk.serial, Slot: slotName(slot)}
+	if att, err := yk.attestation(slot); err == nil {
+		data.Touch = touchPolicyName(att.TouchPolicy)
 	}
-	return nil
+	if a.comment != nil {
+		var b strings.Builder
+		err := a.comment.Execute(&b, data)
+		if err == nil {
+			return b.String()
+		}
+		log.Println("Failed to execute the -comment template:", err)
+	}
+	return defaultKeyComment(data)
 }
 
-func (a *Agent) getPIN() (string, error) {
-	if a.touchNotification != nil && a.touchNotification.Stop() {
-		defer a.touchNotification.Reset(5 * time.Second)
-	}
-	p, err := pinentry.New()
-	if err != nil {
-		return "", fmt.Errorf("failed to start %q: %w", pinentry.GetBinary(), err)
-	}
-	defer p.Close()
-	p.Set("title", "yubikey-agent PIN Prompt")
-	var retries string
-	if r, err := a.yk.Retries(); err == nil {
-		retries = fmt.Sprintf(" (%d tries remaining)", r)
+func defaultKeyComment(data commentData) string {
+	comment := fmt.Sprintf("YubiKey #%d PIV Slot %s", data.Serial, data.Slot)
+	if data.Touch != "" {
+		comment += fmt.Sprintf(" (touch: %s)", data.Touch)
 	}
-	p.Set("desc", fmt.Sprintf("YubiKey serial number: %d"+retries, a.serial))
-	p.Set("prompt", "Please enter your PIN:")
-
-	// Enable opt-in external PIN caching (in the OS keychain).
-	// https://gist.github.com/mdeguzis/05d1f284f931223624834788da045c65#file-info-pinentry-L324
-	p.Option("allow-external-password-cache")
-	p.Set("KEYINFO", fmt.Sprintf("--yubikey-id-%d", a.serial))
+	return comment
+}
 
-	pin, err := p.GetPin()
-	return string(pin), err
+func slotName(slot piv.Slot) string {
+	return fmt.Sprintf("%x", slot.Key)
 }
 
-func (a *Agent) List() ([]*agent.Key, error) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	if err := a.ensureYK(); err != nil {
-		return nil, fmt.Errorf("could not reach YubiKey: %w", err)
+// parseSlot returns the slot with the given name, like "9a" or "82".
+func parseSlot(name string) (piv.Slot, error) {
+	for _, slot := range allSlots {
+		if slotName(slot) == strings.ToLower(name) {
+			return slot, nil
+		}
 	}
+	return piv.Slot{}, fmt.Errorf("unknown PIV slot %q", name)
+}
 
-	pk, err := getPublicKey(a.yk, piv.SlotAuthentication)
-	if err != nil {
-		return nil, err
+type slotKey struct {
+	yk   *yubiKey
+	slot piv.Slot
+	pk   ssh.PublicKey
+}
+
+// slotKeys returns the public keys of all populated slots of all connected
+// YubiKeys. Empty slots are skipped, and so are slots holding keys that can't
+// be used for SSH or that are not allowed by -allow-key.
+func (a *Agent) slotKeys() ([]slotKey, error) {
+	var keys []slotKey
+	for _, yk := range a.yks {
+		for _, slot := range a.slots {
+			pk, err := yk.publicKey(slot)
+			if errors.Is(err, ErrEmptySlot) {
+				continue
+			} else if err != nil {
+				log.Printf("Skipping YubiKey #%d PIV slot %s: %v", yk.serial, slotName(slot), err)
+				continue
+			}
+			if len(a.allowedKeys) > 0 && !a.allowedKeys[ssh.FingerprintSHA256(pk)] {
+				continue
+			}
+			if !a.noAttestCheck {
+				if err := yk.verifyKey(slot, pk); err != nil {
+					log.Printf("Refusing YubiKey #%d PIV slot %s: %v", yk.serial, slotName(slot), err)
+					continue
+				}
+			}
+			keys = append(keys, slotKey{yk: yk, slot: slot, pk: pk})
+		}
 	}
-	return []*agent.Key{{
-		Format:  pk.Type(),
-		Blob:    pk.Marshal(),
-		Comment: fmt.Sprintf("YubiKey #%d PIV Slot 9a", a.serial),
-	}}, nil
+	return keys, nil
 }
 
-func getPublicKey(yk *piv.YubiKey, slot piv.Slot) (ssh.PublicKey, error) {
+// ErrEmptySlot is returned when a PIV slot has no key, see ErrNoYubiKey.
+var ErrEmptySlot = errors.New("no key in PIV slot")
+
+// getPublicKey returns the public key in slot. It's read from the slot
+// certificate, or if there is none, from the attestation of the slot, which
+// is available for keys generated on the YubiKey by tools that don't store a
+// certificate. Imported keys need a certificate.
+func getPublicKey(yk pivDevice, slot piv.Slot) (ssh.PublicKey, error) {
+	var pub crypto.PublicKey
 	cert, err := yk.Certificate(slot)
-	if err != nil {
+	if err == nil {
+		pub = cert.PublicKey
+	} else if attCert, attErr := yk.Attest(slot); attErr == nil {
+		logEvent("debug", "key", "Public key read from the attestation", logFields{
+			"slot":  slotName(slot),
+			"error": err.Error(),
+		})
+		pub = attCert.PublicKey
+	} else if errors.Is(err, piv.ErrNotFound) {
+		// An empty slot has neither, and the certificate error wraps
+		// piv.ErrNotFound in that case.
+		return nil, fmt.Errorf("%w %s", ErrEmptySlot, slotName(slot))
+	} else {
 		return nil, fmt.Errorf("could not get public key: %w", err)
 	}
-	switch cert.PublicKey.(type) {
+	switch pub := pub.(type) {
 	case *ecdsa.PublicKey:
+		// The PIV applet can only sign with P-256 and P-384 keys, which map to
+		// the ecdsa-sha2-nistp256 and ecdsa-sha2-nistp384 SSH key types.
+		switch pub.Curve {
+		case elliptic.P256(), elliptic.P384():
+		default:
+			return nil, fmt.Errorf("unsupported ECDSA curve: %s", pub.Curve.Params().Name)
+		}
 	case *rsa.PublicKey:
 	default:
-		return nil, fmt.Errorf("unexpected public key type: %T", cert.PublicKey)
+		return nil, fmt.Errorf("unexpected public key type: %T", pub)
 	}
-	pk, err := ssh.NewPublicKey(cert.PublicKey)
+	pk, err := ssh.NewPublicKey(pub)
 	if err != nil {
 		return nil, fmt.Errorf("failed to process public key: %w", err)
 	}
 	return pk, nil
 }
 
+// attest returns the attestation of the key in slot, which includes its PIN
+// and touch policies. It fails for keys that were not generated on the YubiKey.
+func attest(yk *yubiKey, slot piv.Slot) (*piv.Attestation, error) {
+	if m, ok := yk.pivDevice.(*mockYubiKey); ok {
+		return m.attestation(slot)
+	}
+	ykCert, err := yk.AttestationCertificate()
+	if err != nil {
+		return nil, fmt.Errorf("could not get attestation certificate: %w", err)
+	}
+	slotCert, err := yk.Attest(slot)
+	if err != nil {
+		return nil, fmt.Errorf("could not attest slot: %w", err)
+	}
+	return piv.Verify(ykCert, slotCert)
+}
+
+// verifyKey checks that the key in slot, whose public key is pk, was generated
+// on a genuine YubiKey: the slot attestation certificate must be for pk, and
+// must chain through the device attestation certificate to the Yubico root.
+// Successful checks are remembered until the YubiKey is reconnected.
+func (yk *yubiKey) verifyKey(slot piv.Slot, pk ssh.PublicKey) error {
+	if bytes.Equal(yk.verified[slot], pk.Marshal()) {
+		return nil
+	}
+	ykCert, err := yk.AttestationCertificate()
+	if err != nil {
+		return fmt.Errorf("could not get the device attestation certificate: %w", err)
+	}
+	slotCert, err := yk.Attest(slot)
+	if err != nil {
+		return fmt.Errorf("the key can't be attested, like keys imported rather than generated on the YubiKey, pass -no-attest-check to use it: %w", err)
+	}
+	// piv.Verify checks the device certificate against the Yubico PIV root,
+	// and the slot certificate against the device certificate, and its
+	// errors say which of the two failed.
+	att, err := piv.Verify(ykCert, slotCert)
+	if err != nil {
+		return fmt.Errorf("attestation chain verification failed: %w", err)
+	}
+	attested, err := ssh.NewPublicKey(slotCert.PublicKey)
+	if err != nil {
+		return fmt.Errorf("unsupported attested key: %w", err)
+	}
+	if !bytes.Equal(attested.Marshal(), pk.Marshal()) {
+		return errors.New("the attested key doesn't match the slot certificate")
+	}
+	if yk.verified == nil {
+		yk.verified = make(map[piv.Slot][]byte)
+	}
+	yk.verified[slot] = pk.Marshal()
+	if yk.attestations == nil {
+		yk.attestations = make(map[piv.Slot]*piv.Attestation)
+	}
+	yk.attestations[slot] = att
+	return nil
+}
+
+// touchRequired reports whether the YubiKey requires a touch to use the key in
+// slot, according to its attestation. If it can't be attested, it's assumed
+// not to.
+func (yk *yubiKey) touchRequired(slot piv.Slot) bool {
+	att, err := yk.attestation(slot)
+	if err != nil {
+		return false
+	}
+	return att.TouchPolicy == piv.TouchPolicyAlways || att.TouchPolicy == piv.TouchPolicyCached
+}
+
+// attestation returns the attestation of the key in slot, like attest, but
+// caches it until the YubiKey is reconnected.
+func (yk *yubiKey) attestation(slot piv.Slot) (*piv.Attestation, error) {
+	if att, ok := yk.attestations[slot]; ok {
+		return att, nil
+	}
+	att, err := attest(yk, slot)
+	if err != nil {
+		return nil, err
+	}
+	if yk.attestations == nil {
+		yk.attestations = make(map[piv.Slot]*piv.Attestation)
+	}
+	yk.attestations[slot] = att
+	return att, nil
+}
+
 func (a *Agent) Signers() ([]ssh.Signer, error) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
+	if a.locked {
+		return nil, ErrAgentLocked
+	}
 	if err := a.ensureYK(); err != nil {
 		return nil, fmt.Errorf("could not reach YubiKey: %w", err)
 	}
@@ -269,14 +1996,64 @@ func (a *Agent) Signers() ([]ssh.Signer, error) {
 }
 
 func (a *Agent) signers() ([]ssh.Signer, error) {
-	pk, err := getPublicKey(a.yk, piv.SlotAuthentication)
+	keys, err := a.slotKeys()
 	if err != nil {
 		return nil, err
 	}
-	priv, err := a.yk.PrivateKey(
-		piv.SlotAuthentication,
-		pk.(ssh.CryptoPublicKey).CryptoPublicKey(),
-		piv.KeyAuth{PINPrompt: a.getPIN},
+	var signers []ssh.Signer
+	for _, k := range keys {
+		s, err := a.signer(k)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, s)
+		for _, cert := range a.certsForKey(k) {
+			cs, err := ssh.NewCertSigner(cert.Certificate, s)
+			if err != nil {
+				return nil, fmt.Errorf("failed to prepare certificate signer: %w", err)
+			}
+			signers = append(signers, cs)
+		}
+	}
+	return signers, nil
+}
+
+// signer returns a signer for the key k, which asks for the PIN when needed.
+// Signers are cached until the YubiKey is reconnected, and they still ask for
+// the PIN and touch on every use as required by the key policies.
+func (a *Agent) signer(k slotKey) (ssh.Signer, error) {
+	if s, ok := k.yk.signers[k.slot]; ok && bytes.Equal(s.PublicKey().Marshal(), k.pk.Marshal()) {
+		return s, nil
+	}
+
+	// Keys with the "always" PIN policy require the user to enter the PIN
+	// for every signature, so for them the PIN caches are bypassed. Passing
+	// the policy also saves piv-go from attesting the key again, which would
+	// fail for imported keys: for those, assume the PIN is needed once, as
+	// piv-go then only asks for it if the YubiKey is not logged in.
+	auth := piv.KeyAuth{PINPolicy: piv.PINPolicyOnce}
+	var pinAlways bool
+	if att, err := k.yk.attestation(k.slot); err == nil {
+		auth.PINPolicy = att.PINPolicy
+		pinAlways = att.PINPolicy == piv.PINPolicyAlways
+	} else {
+		logEvent("debug", "key", "Unknown PIN policy, assuming once", logFields{
+			"serial": k.yk.serial,
+			"slot":   slotName(k.slot),
+			"error":  err.Error(),
+		})
+	}
+	auth.PINPrompt = func() (string, error) {
+		// piv-go takes the PIN as a string, which can't be wiped, but at
+		// least the buffers it was read into are.
+		pin, err := a.getPIN(k.yk, pinAlways)
+		defer zeroBytes(pin)
+		return string(pin), err
+	}
+	priv, err := k.yk.PrivateKey(
+		k.slot,
+		k.pk.(ssh.CryptoPublicKey).CryptoPublicKey(),
+		auth,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare private key: %w", err)
@@ -285,7 +2062,11 @@ func (a *Agent) signers() ([]ssh.Signer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare signer: %w", err)
 	}
-	return []ssh.Signer{s}, nil
+	if k.yk.signers == nil {
+		k.yk.signers = make(map[piv.Slot]ssh.Signer)
+	}
+	k.yk.signers[k.slot] = s
+	return s, nil
 }
 
 func (a *Agent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
@@ -293,61 +2074,333 @@ func (a *Agent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
 }
 
 func (a *Agent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+	return a.sign(key, data, flags, nil, nil)
+}
+
+// errRateLimited is returned when a signature exceeds -max-signs-per-minute.
+var errRateLimited = errors.New("too many signatures, refusing to sign (see -max-signs-per-minute)")
+
+// takeSignToken reports whether a signature is allowed by maxSignsPerMinute,
+// and if so consumes a token. Up to maxSignsPerMinute signatures can be made
+// in a burst, and then one more every 60s / maxSignsPerMinute. It must be
+// called with a.mu held.
+func (a *Agent) takeSignToken() bool {
+	if a.maxSignsPerMinute <= 0 {
+		return true
+	}
+	max := float64(a.maxSignsPerMinute)
+	now := time.Now()
+	if a.signTokensTime.IsZero() {
+		a.signTokens = max
+	} else {
+		a.signTokens += now.Sub(a.signTokensTime).Minutes() * max
+		if a.signTokens > max {
+			a.signTokens = max
+		}
+	}
+	a.signTokensTime = now
+	if a.signTokens < 1 {
+		return false
+	}
+	a.signTokens--
+	return true
+}
+
+// errSignTimeout is returned when a signature takes longer than -sign-timeout.
+var errSignTimeout = errors.New("timed out waiting for the signature, was the YubiKey touched?")
+
+// sign implements SignWithFlags. session is the session the connection is
+// bound to, if any, and is used to describe the request. If slots is not nil,
+// only keys in those slots can be used.
+//
+// If signTimeout is set, the signature is made in the background, and sign
+// gives up on it after signTimeout. PC/SC operations can't be canceled, so the
+// abandoned signature keeps a.mu until the YubiKey returns, for example when
+// its touch times out, and then the YubiKeys are reopened to start the next
+// request from a clean state.
+func (a *Agent) sign(key ssh.PublicKey, data []byte, flags agent.SignatureFlags, session *sessionBinding, slots map[piv.Slot]bool) (*ssh.Signature, error) {
+	if a.signTimeout == 0 {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.signLocked(key, data, flags, session, slots)
+	}
+
+	type result struct {
+		sig *ssh.Signature
+		err error
+	}
+	done := make(chan result, 1)
+	abandoned := make(chan struct{})
+	t := time.NewTimer(a.signTimeout)
+	go func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		// The request might have timed out while waiting for another one,
+		// like a PIN prompt. Don't ask for the PIN or a touch for a signature
+		// that would be thrown away, and that with -once would not count.
+		select {
+		case <-abandoned:
+			return
+		default:
+		}
+		a.signTimer = t
+		sig, err := a.signLocked(key, data, flags, session, slots)
+		a.signTimer = nil
+		done <- result{sig, err}
+		select {
+		case <-abandoned:
+			a.closeYKs()
+		default:
+		}
+	}()
+	select {
+	case r := <-done:
+		t.Stop()
+		return r.sig, r.err
+	case <-t.C:
+		close(abandoned)
+		atomic.AddUint64(&a.signatureErrors, 1)
+		logEvent("error", "error", "Signature timed out", logFields{
+			"timeout": a.signTimeout.String(),
+		})
+		return nil, errSignTimeout
+	}
+}
+
+// signLocked implements sign. It must be called with a.mu held.
+func (a *Agent) signLocked(key ssh.PublicKey, data []byte, flags agent.SignatureFlags, session *sessionBinding, slots map[piv.Slot]bool) (*ssh.Signature, error) {
+	if a.locked {
+		return nil, ErrAgentLocked
+	}
 	if err := a.ensureYK(); err != nil {
 		return nil, fmt.Errorf("could not reach YubiKey: %w", err)
 	}
 
-	signers, err := a.signers()
+	keys, err := a.slotKeys()
 	if err != nil {
 		return nil, err
 	}
-	for _, s := range signers {
-		if !bytes.Equal(s.PublicKey().Marshal(), key.Marshal()) {
+	for _, k := range keys {
+		if slots != nil && !slots[k.slot] {
 			continue
 		}
-
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		a.touchNotification = time.NewTimer(5 * time.Second)
-		go func() {
-			select {
-			case <-a.touchNotification.C:
-			case <-ctx.Done():
-				a.touchNotification.Stop()
-				return
+		if !bytes.Equal(k.pk.Marshal(), key.Marshal()) && !a.isCertForKey(key, k) {
+			continue
+		}
+		alg, err := signatureAlgorithm(k.pk, data, flags, a.noSHA1)
+		if err != nil {
+			atomic.AddUint64(&a.signatureErrors, 1)
+			logEvent("error", "error", "Signature refused", logFields{
+				"fingerprint": ssh.FingerprintSHA256(key),
+				"flags":       signatureFlagsString(flags),
+				"error":       err.Error(),
+			})
+			return nil, err
+		}
+		// Only spend a token once a usable key matched, so that requests for
+		// other keys, or from peers -peer-slots keeps out of this one, can't
+		// exhaust the budget of the owner.
+		if !a.takeSignToken() {
+			atomic.AddUint64(&a.signatureErrors, 1)
+			logEvent("error", "rate-limit", "Signature refused, too many signatures", logFields{
+				"fingerprint": ssh.FingerprintSHA256(key),
+				"limit":       a.maxSignsPerMinute,
+			})
+			return nil, errRateLimited
+		}
+		if a.confirm || a.requireTouch && !k.yk.touchRequired(k.slot) {
+			if err := a.confirmSignature(k, session); err != nil {
+				return nil, err
 			}
-			showNotification("Waiting for YubiKey touch...")
-		}()
+		}
+		s, err := a.signer(k)
+		if err != nil {
+			return nil, err
+		}
 
-		alg := key.Type()
-		switch {
-		case alg == ssh.KeyAlgoRSA && flags&agent.SignatureFlagRsaSha256 != 0:
-			alg = ssh.SigAlgoRSASHA2256
-		case alg == ssh.KeyAlgoRSA && flags&agent.SignatureFlagRsaSha512 != 0:
-			alg = ssh.SigAlgoRSASHA2512
+		a.armTouchNotification(k)
+		defer a.disarmTouchNotification()
+
+		logEvent("debug", "sign", "Selected the signature algorithm", logFields{
+			"serial":    k.yk.serial,
+			"slot":      slotName(k.slot),
+			"key_type":  k.pk.Type(),
+			"flags":     signatureFlagsString(flags),
+			"algorithm": signatureAlgorithmName(k.pk, alg),
+		})
+		retried := false
+		// If the PIN is not correct, ask for it again until the YubiKey blocks it.
+		for {
+			sig, err := s.(ssh.AlgorithmSigner).SignWithAlgorithm(rand.Reader, data, alg)
+			if err != nil && !retried && isTransient(err) {
+				// The YubiKey is probably fine, but the connection to it is
+				// not. Reconnect and try exactly once more.
+				retried = true
+				logEvent("warning", "reconnect", "Transient smart card error, reconnecting to retry the signature", logFields{
+					"serial": k.yk.serial,
+					"slot":   slotName(k.slot),
+					"error":  err.Error(),
+				})
+				if k, s, err = a.reopenSlotKey(k); err == nil {
+					continue
+				}
+			}
+			var authErr piv.AuthErr
+			if errors.As(err, &authErr) {
+				// Don't keep retrying a cached PIN that was rejected.
+				a.forgetPIN(k.yk.serial)
+				if a.keychain != nil {
+					a.keychain.delete(k.yk.serial)
+				}
+				if authErr.Retries == 0 {
+					atomic.AddUint64(&a.signatureErrors, 1)
+					return nil, fmt.Errorf("YubiKey #%d PIN blocked, it can be unblocked with the PUK", k.yk.serial)
+				}
+				log.Printf("Incorrect PIN for YubiKey #%d, %d tries remaining", k.yk.serial, authErr.Retries)
+				k.yk.wrongPIN = true
+				continue
+			}
+			if err != nil {
+				atomic.AddUint64(&a.signatureErrors, 1)
+				logEvent("error", "error", "Signature failed", logFields{
+					"serial": k.yk.serial,
+					"slot":   slotName(k.slot),
+					"error":  err.Error(),
+				})
+				return nil, err
+			}
+			count := atomic.AddUint64(&a.signatures, 1)
+			logEvent("info", "sign", "Signature issued", logFields{
+				"count":       count,
+				"serial":      k.yk.serial,
+				"slot":        slotName(k.slot),
+				"fingerprint": ssh.FingerprintSHA256(k.pk),
+				"algorithm":   sig.Format,
+			})
+			return sig, nil
 		}
-		// TODO: maybe retry if the PIN is not correct?
-		return s.(ssh.AlgorithmSigner).SignWithAlgorithm(rand.Reader, data, alg)
 	}
 	return nil, fmt.Errorf("no private keys match the requested public key")
 }
 
-func showNotification(message string) {
-	switch runtime.GOOS {
-	case "darwin":
-		message = strings.ReplaceAll(message, `\`, `\\`)
-		message = strings.ReplaceAll(message, `"`, `\"`)
-		appleScript := `display notification "%s" with title "yubikey-agent"`
-		exec.Command("osascript", "-e", fmt.Sprintf(appleScript, message)).Run()
-	case "linux":
-		exec.Command("notify-send", "-i", "dialog-password", "yubikey-agent", message).Run()
+// transientErrors are the messages of the PC/SC errors that can be caused by a
+// reset of the card or a brief contention, after which reconnecting to the
+// YubiKey usually works. piv-go doesn't expose the error codes.
+var transientErrors = []string{
+	"the smart card has been reset, so any shared state information is invalid",
+	"the smart card is not responding to a reset",
+	"a communications error with the smart card has been detected",
+	"an internal communications error has been detected",
+	"an attempt was made to end a non-existent transaction",
+}
+
+// isTransient reports whether err is a transient PC/SC error, see
+// transientErrors. Authentication errors are never transient.
+func isTransient(err error) bool {
+	var authErr piv.AuthErr
+	if errors.As(err, &authErr) {
+		return false
+	}
+	for _, msg := range transientErrors {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// reopenSlotKey reconnects to the YubiKeys, and returns k and its signer from
+// the new connection. It fails if the YubiKey or the key are gone. It must be
+// called with a.mu held.
+func (a *Agent) reopenSlotKey(k slotKey) (slotKey, ssh.Signer, error) {
+	atomic.AddUint64(&a.reconnects, 1)
+	a.closeYKs()
+	if err := a.ensureYK(); err != nil {
+		return k, nil, fmt.Errorf("could not reach YubiKey: %w", err)
+	}
+	for _, yk := range a.yks {
+		if yk.serial != k.yk.serial {
+			continue
+		}
+		pk, err := yk.publicKey(k.slot)
+		if err != nil {
+			return k, nil, err
+		}
+		if !bytes.Equal(pk.Marshal(), k.pk.Marshal()) {
+			return k, nil, errors.New("the key changed while reconnecting")
+		}
+		k = slotKey{yk: yk, slot: k.slot, pk: pk}
+		s, err := a.signer(k)
+		return k, s, err
+	}
+	return k, nil, fmt.Errorf("YubiKey #%d is gone after reconnecting", k.yk.serial)
+}
+
+// sshsigMagic starts the data signed for SSHSIG signatures, made by
+// ssh-keygen -Y sign, for example for git. See PROTOCOL.sshsig in OpenSSH.
+var sshsigMagic = []byte("SSHSIG")
+
+// signatureAlgorithm returns the signature algorithm to use with pk for a
+// request to sign data with the given flags. The SHA-2 flags only apply to RSA
+// keys, and with noSHA1, requests without flags get SHA-256 rather than the
+// legacy SHA-1 ssh-rsa signatures. SSHSIG requests without flags, like git
+// commit signatures, get SHA-512 like ssh-keygen -Y sign would ask for, since
+// verifiers reject SHA-1. ECDSA keys have a single signature algorithm matching
+// their key type, selected by the empty string.
+//
+// There is no RSA-PSS signature algorithm or flag in the SSH agent protocol,
+// and piv-go refuses PSS options anyway, so unknown flags, which a client
+// might use to ask for one, are an error for RSA keys rather than silently
+// producing a PKCS #1 v1.5 signature. They are ignored for other keys.
+func signatureAlgorithm(pk ssh.PublicKey, data []byte, flags agent.SignatureFlags, noSHA1 bool) (string, error) {
+	if pk.Type() != ssh.KeyAlgoRSA {
+		return "", nil
+	}
+	if unknown := flags &^ (agent.SignatureFlagRsaSha256 | agent.SignatureFlagRsaSha512); unknown != 0 {
+		return "", fmt.Errorf("unsupported signature flags %#x: RSA-PSS is not supported by the YubiKey, only PKCS #1 v1.5", uint32(unknown))
+	}
+	switch {
+	case flags&agent.SignatureFlagRsaSha256 != 0:
+		return ssh.SigAlgoRSASHA2256, nil
+	case flags&agent.SignatureFlagRsaSha512 != 0:
+		return ssh.SigAlgoRSASHA2512, nil
+	case bytes.HasPrefix(data, sshsigMagic):
+		return ssh.SigAlgoRSASHA2512, nil
+	case noSHA1:
+		return ssh.SigAlgoRSASHA2256, nil
+	default:
+		return ssh.SigAlgoRSA, nil
+	}
+}
+
+// signatureFlagsString describes the flags of a signature request, like
+// "rsa-sha2-256", or "none" when the client left the choice to the agent, which
+// for RSA keys is how clients ask for legacy SHA-1 signatures.
+func signatureFlagsString(flags agent.SignatureFlags) string {
+	var names []string
+	if flags&agent.SignatureFlagRsaSha256 != 0 {
+		names = append(names, ssh.SigAlgoRSASHA2256)
+	}
+	if flags&agent.SignatureFlagRsaSha512 != 0 {
+		names = append(names, ssh.SigAlgoRSASHA2512)
+	}
+	if unknown := flags &^ (agent.SignatureFlagRsaSha256 | agent.SignatureFlagRsaSha512); unknown != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint32(unknown)))
 	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
 }
 
-func (a *Agent) Extension(extensionType string, contents []byte) ([]byte, error) {
-	return nil, agent.ErrExtensionUnsupported
+// signatureAlgorithmName returns the name of the signature algorithm alg,
+// chosen by signatureAlgorithm for pk, which is the key type for the empty
+// string.
+func signatureAlgorithmName(pk ssh.PublicKey, alg string) string {
+	if alg == "" {
+		return pk.Type()
+	}
+	return alg
 }
 
 var ErrOperationUnsupported = errors.New("operation unsupported")
@@ -361,9 +2414,36 @@ func (a *Agent) Remove(key ssh.PublicKey) error {
 func (a *Agent) RemoveAll() error {
 	return ErrOperationUnsupported
 }
+
+var ErrAgentLocked = errors.New("agent locked")
+
+// Lock locks the agent with a passphrase, until Unlock is called with the same
+// passphrase. It also drops the YubiKey transactions, so the PIN will have to
+// be entered again after unlocking.
 func (a *Agent) Lock(passphrase []byte) error {
-	return ErrOperationUnsupported
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return ErrAgentLocked
+	}
+	a.locked = true
+	a.lockHash = sha256.Sum256(passphrase)
+	a.closeYKs()
+	a.forgetPINs()
+	return nil
 }
+
 func (a *Agent) Unlock(passphrase []byte) error {
-	return ErrOperationUnsupported
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.locked {
+		return errors.New("agent not locked")
+	}
+	h := sha256.Sum256(passphrase)
+	if subtle.ConstantTimeCompare(h[:], a.lockHash[:]) != 1 {
+		return errors.New("incorrect passphrase")
+	}
+	a.locked = false
+	a.lockHash = [sha256.Size]byte{}
+	return nil
 }
@@ -0,0 +1,490 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-piv/piv-go/piv"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// newTestAgent returns an Agent using a fresh simulated YubiKey, which
+// doesn't wait for touches, and which gets the PIN from a helper, see
+// servePINHelper.
+func newTestAgent(t testing.TB) (*Agent, *mockYubiKey) {
+	t.Helper()
+	delay := mockTouchDelay
+	mockTouchDelay = 0
+	t.Cleanup(func() { mockTouchDelay = delay })
+	m, err := newMockYubiKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Agent{
+		started:         time.Now(),
+		mock:            m,
+		slots:           allSlots,
+		noAttestCheck:   true,
+		pinHelperSocket: servePINHelper(t, piv.DefaultPIN),
+	}
+	t.Cleanup(func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.closeYKs()
+	})
+	return a, m
+}
+
+// servePINHelper starts a -pin-helper-socket that answers every request
+// with pin, and returns its path. Tests count the prompts with a.pinPrompts.
+func servePINHelper(t testing.TB, pin string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "yubikey-agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "pin-helper.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(c).ReadString('\n')
+			fmt.Fprintf(c, "OK %s\n", pin)
+			c.Close()
+		}
+	}()
+	return path
+}
+
+// addMockKey generates a key in slot of m with opts, and stores a certificate
+// for it like -setup does, so that the agent finds it.
+func addMockKey(t testing.TB, m *mockYubiKey, slot piv.Slot, opts piv.Key) ssh.PublicKey {
+	t.Helper()
+	pub, err := m.GenerateKey(m.managementKey, slot, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storeCertificate(m, m.managementKey, slot, pub); err != nil {
+		t.Fatal(err)
+	}
+	pk, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
+
+// TestSign checks the signature algorithm picked for each key type, signature
+// flags, -no-sha1, and SSHSIG data, as signed by ssh-keygen -Y sign for git.
+// RSA SSHSIG signatures are made with SHA-512 when the client doesn't ask for
+// an algorithm. Unknown flags fail, since on devices that can't make RSA-PSS
+// signatures they might ask for one, and a PKCS #1 v1.5 signature would be
+// wrong.
+func TestSign(t *testing.T) {
+	const unknownFlag = 1 << 3
+	both := agent.SignatureFlagRsaSha256 | agent.SignatureFlagRsaSha512
+	data := []byte("test data")
+	// The data signed for SSHSIG, see PROTOCOL.sshsig in OpenSSH.
+	h := sha512.Sum512([]byte("tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n"))
+	sshsig := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace, Reserved, HashAlgorithm string
+		Hash                               []byte
+	}{"git", "", "sha512", h[:]})...)
+
+	for _, tt := range []struct {
+		name    string
+		alg     piv.Algorithm
+		data    []byte
+		flags   agent.SignatureFlags
+		noSHA1  bool
+		wantAlg string // empty if an error is expected
+	}{
+		{"EC256", piv.AlgorithmEC256, data, 0, false, ssh.KeyAlgoECDSA256},
+		{"EC256, sha256", piv.AlgorithmEC256, data, agent.SignatureFlagRsaSha256, false, ssh.KeyAlgoECDSA256},
+		{"EC256, sha512", piv.AlgorithmEC256, data, agent.SignatureFlagRsaSha512, false, ssh.KeyAlgoECDSA256},
+		{"EC256, both", piv.AlgorithmEC256, data, both, false, ssh.KeyAlgoECDSA256},
+		{"EC256, no-sha1", piv.AlgorithmEC256, data, 0, true, ssh.KeyAlgoECDSA256},
+		{"EC384", piv.AlgorithmEC384, data, 0, false, ssh.KeyAlgoECDSA384},
+		{"EC384, sha256", piv.AlgorithmEC384, data, agent.SignatureFlagRsaSha256, false, ssh.KeyAlgoECDSA384},
+		{"EC384, sha512", piv.AlgorithmEC384, data, agent.SignatureFlagRsaSha512, false, ssh.KeyAlgoECDSA384},
+		{"EC384, both", piv.AlgorithmEC384, data, both, false, ssh.KeyAlgoECDSA384},
+		{"EC384, no-sha1", piv.AlgorithmEC384, data, 0, true, ssh.KeyAlgoECDSA384},
+		{"RSA1024", piv.AlgorithmRSA1024, data, 0, false, ssh.SigAlgoRSA},
+		{"RSA1024, sha256", piv.AlgorithmRSA1024, data, agent.SignatureFlagRsaSha256, false, ssh.SigAlgoRSASHA2256},
+		{"RSA1024, sha512", piv.AlgorithmRSA1024, data, agent.SignatureFlagRsaSha512, false, ssh.SigAlgoRSASHA2512},
+		{"RSA1024, both", piv.AlgorithmRSA1024, data, both, false, ssh.SigAlgoRSASHA2256},
+		{"RSA1024, no-sha1", piv.AlgorithmRSA1024, data, 0, true, ssh.SigAlgoRSASHA2256},
+		{"RSA2048", piv.AlgorithmRSA2048, data, 0, false, ssh.SigAlgoRSA},
+		{"RSA2048, sha256", piv.AlgorithmRSA2048, data, agent.SignatureFlagRsaSha256, false, ssh.SigAlgoRSASHA2256},
+		{"RSA2048, sha512", piv.AlgorithmRSA2048, data, agent.SignatureFlagRsaSha512, false, ssh.SigAlgoRSASHA2512},
+		{"RSA2048, both", piv.AlgorithmRSA2048, data, both, false, ssh.SigAlgoRSASHA2256},
+		{"RSA2048, no-sha1", piv.AlgorithmRSA2048, data, 0, true, ssh.SigAlgoRSASHA2256},
+		{"RSA2048, unknown", piv.AlgorithmRSA2048, data, unknownFlag, false, ""},
+		{"RSA2048, sha512 and unknown", piv.AlgorithmRSA2048, data, agent.SignatureFlagRsaSha512 | unknownFlag, false, ""},
+		{"RSA2048, sshsig", piv.AlgorithmRSA2048, sshsig, 0, false, ssh.SigAlgoRSASHA2512},
+		{"RSA2048, sshsig, no-sha1", piv.AlgorithmRSA2048, sshsig, 0, true, ssh.SigAlgoRSASHA2512},
+		{"RSA2048, sshsig, sha256", piv.AlgorithmRSA2048, sshsig, agent.SignatureFlagRsaSha256, false, ssh.SigAlgoRSASHA2256},
+		{"EC256, sshsig", piv.AlgorithmEC256, sshsig, 0, false, ssh.KeyAlgoECDSA256},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, m := newTestAgent(t)
+			a.noSHA1 = tt.noSHA1
+			pk := addMockKey(t, m, piv.SlotSignature, piv.Key{
+				Algorithm:   tt.alg,
+				PINPolicy:   piv.PINPolicyNever,
+				TouchPolicy: piv.TouchPolicyNever,
+			})
+			sig, err := a.SignWithFlags(pk, tt.data, tt.flags)
+			if tt.wantAlg == "" {
+				if err == nil {
+					t.Fatalf("got a %s signature, expected an error", sig.Format)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sig.Format != tt.wantAlg {
+				t.Errorf("got a %s signature, expected %s", sig.Format, tt.wantAlg)
+			}
+			if err := pk.Verify(tt.data, sig); err != nil {
+				t.Errorf("signature doesn't verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestPINPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		policy      piv.PINPolicy
+		pinCache    time.Duration
+		logOut      bool
+		wantPrompts uint64
+	}{
+		{"once", piv.PINPolicyOnce, 0, false, 1},
+		{"once, logged out", piv.PINPolicyOnce, 0, true, 3},
+		{"once, logged out, cached", piv.PINPolicyOnce, time.Hour, true, 1},
+		{"always", piv.PINPolicyAlways, 0, false, 3},
+		{"always, cached", piv.PINPolicyAlways, time.Hour, false, 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, m := newTestAgent(t)
+			a.pinCacheTTL = tt.pinCache
+			pk := addMockKey(t, m, piv.SlotSignature, piv.Key{
+				Algorithm:   piv.AlgorithmEC256,
+				PINPolicy:   tt.policy,
+				TouchPolicy: piv.TouchPolicyNever,
+			})
+			for i := 0; i < 3; i++ {
+				if tt.logOut {
+					// Like the YubiKey being reset by another application.
+					m.Close()
+				}
+				if _, err := a.Sign(pk, []byte("test data")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := atomic.LoadUint64(&a.pinPrompts); got != tt.wantPrompts {
+				t.Errorf("got %d PIN prompts, expected %d", got, tt.wantPrompts)
+			}
+		})
+	}
+}
+
+// BenchmarkSign compares signatures with the signer cached across requests,
+// as the agent does, to preparing it again for each of them.
+func BenchmarkSign(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached=%v", cached), func(b *testing.B) {
+			a, m := newTestAgent(b)
+			pk := addMockKey(b, m, piv.SlotSignature, piv.Key{
+				Algorithm:   piv.AlgorithmEC256,
+				PINPolicy:   piv.PINPolicyNever,
+				TouchPolicy: piv.TouchPolicyNever,
+			})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !cached {
+					a.mu.Lock()
+					for _, yk := range a.yks {
+						yk.signers = nil
+					}
+					a.mu.Unlock()
+				}
+				if _, err := a.Sign(pk, []byte("test data")); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSignRetry(t *testing.T) {
+	transient := errors.New(transientErrors[0])
+	for _, tt := range []struct {
+		name           string
+		failures       []error
+		wantErr        bool
+		wantReconnects uint64
+	}{
+		{"no failure", nil, false, 0},
+		{"one transient failure", []error{transient}, false, 1},
+		{"two transient failures", []error{transient, transient}, true, 1},
+		{"other failure", []error{errors.New("smart card error 6a80")}, true, 0},
+		{"PIN blocked", []error{piv.AuthErr{Retries: 0}}, true, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, m := newTestAgent(t)
+			pk := addMockKey(t, m, piv.SlotSignature, piv.Key{
+				Algorithm:   piv.AlgorithmEC256,
+				PINPolicy:   piv.PINPolicyNever,
+				TouchPolicy: piv.TouchPolicyNever,
+			})
+			m.failSigns = tt.failures
+			_, err := a.Sign(pk, []byte("test data"))
+			if tt.wantErr && err == nil {
+				t.Error("signature succeeded, expected an error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("signature failed: %v", err)
+			}
+			if got := atomic.LoadUint64(&a.reconnects); got != tt.wantReconnects {
+				t.Errorf("got %d reconnects, expected %d", got, tt.wantReconnects)
+			}
+		})
+	}
+}
+
+// TestListWithoutPIN checks that enumerating the keys never asks for the PIN,
+// whatever their PIN policy.
+func TestListWithoutPIN(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		list func(a *Agent) (int, error)
+	}{
+		{"List", func(a *Agent) (int, error) {
+			keys, err := a.List()
+			return len(keys), err
+		}},
+		{"Signers", func(a *Agent) (int, error) {
+			signers, err := a.Signers()
+			return len(signers), err
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, m := newTestAgent(t)
+			a.pinCacheTTL = time.Hour
+			// The Authentication slot already has a key with the once policy.
+			addMockKey(t, m, piv.SlotSignature, piv.Key{
+				Algorithm:   piv.AlgorithmEC256,
+				PINPolicy:   piv.PINPolicyAlways,
+				TouchPolicy: piv.TouchPolicyAlways,
+			})
+			addMockKey(t, m, piv.SlotCardAuthentication, piv.Key{
+				Algorithm:   piv.AlgorithmRSA2048,
+				PINPolicy:   piv.PINPolicyNever,
+				TouchPolicy: piv.TouchPolicyNever,
+			})
+			for i := 0; i < 3; i++ {
+				n, err := tt.list(a)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != 3 {
+					t.Errorf("got %d keys, expected 3", n)
+				}
+			}
+			if got := atomic.LoadUint64(&a.pinPrompts); got != 0 {
+				t.Errorf("got %d PIN prompts, expected none", got)
+			}
+			if m.loggedIn {
+				t.Error("the PIN was verified")
+			}
+		})
+	}
+}
+
+// TestImportedKey checks that a key imported rather than generated on the
+// YubiKey is read from its certificate, and is only used with -no-attest-check,
+// since it can't be attested.
+func TestImportedKey(t *testing.T) {
+	for _, noAttestCheck := range []bool{false, true} {
+		t.Run(fmt.Sprintf("no-attest-check=%v", noAttestCheck), func(t *testing.T) {
+			a, m := newTestAgent(t)
+			a.slots = []piv.Slot{piv.SlotSignature}
+			a.noAttestCheck = noAttestCheck
+			priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.slots[piv.SlotSignature] = &mockSlot{priv: priv, opts: piv.Key{
+				Algorithm:   piv.AlgorithmEC256,
+				PINPolicy:   piv.PINPolicyNever,
+				TouchPolicy: piv.TouchPolicyNever,
+			}}
+			if err := storeCertificate(m, m.managementKey, piv.SlotSignature, priv.Public()); err != nil {
+				t.Fatal(err)
+			}
+			pk, err := ssh.NewPublicKey(priv.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+			keys, err := a.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if noAttestCheck {
+				if len(keys) != 1 || !bytes.Equal(keys[0].Blob, pk.Marshal()) {
+					t.Errorf("got %d keys, expected the imported one", len(keys))
+				}
+				return
+			}
+			if len(keys) != 0 {
+				t.Errorf("got %d keys, expected the imported one to be refused", len(keys))
+			}
+			if !strings.Contains(logs.String(), "pass -no-attest-check") {
+				t.Errorf("the refusal doesn't mention -no-attest-check: %q", logs.String())
+			}
+		})
+	}
+}
+
+func TestOpenCardsSerial(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		cards      int
+		wantSerial uint32
+		wantYKs    int
+		wantErr    bool
+	}{
+		{"one card", 1, 0, 1, false},
+		{"one card, matching serial", 1, mockSerial, 1, false},
+		{"one card, other serial", 1, mockSerial + 1, 0, true},
+		{"two cards", 2, 0, 2, false},
+		{"two cards, same serial", 2, mockSerial, 0, true},
+		{"two cards, other serial", 2, mockSerial + 1, 0, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestAgent(t)
+			a.wantSerial = tt.wantSerial
+			var cards []string
+			devices := make(map[string]*mockYubiKey)
+			for i := 0; i < tt.cards; i++ {
+				// Every simulated YubiKey has serial number mockSerial.
+				m, err := newMockYubiKey()
+				if err != nil {
+					t.Fatal(err)
+				}
+				card := fmt.Sprintf("Yubico YubiKey %d", i)
+				cards = append(cards, card)
+				devices[card] = m
+			}
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			yks, err := a.openCards(cards, func(card string) (pivDevice, error) {
+				return devices[card], nil
+			})
+			if tt.wantErr && err == nil {
+				t.Errorf("got %d YubiKeys, expected an error", len(yks))
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("failed to open the cards: %v", err)
+			}
+			if len(yks) != tt.wantYKs {
+				t.Errorf("got %d YubiKeys, expected %d", len(yks), tt.wantYKs)
+			}
+		})
+	}
+}
+
+// BenchmarkSignKeepalive compares back-to-back signatures checking the
+// YubiKey before each of them, to skipping the check with -keepalive.
+func BenchmarkSignKeepalive(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, keepalive := range []time.Duration{0, time.Minute} {
+		b.Run(fmt.Sprintf("keepalive=%v", keepalive), func(b *testing.B) {
+			a, m := newTestAgent(b)
+			a.keepalive = keepalive
+			pk := addMockKey(b, m, piv.SlotSignature, piv.Key{
+				Algorithm:   piv.AlgorithmEC256,
+				PINPolicy:   piv.PINPolicyNever,
+				TouchPolicy: piv.TouchPolicyNever,
+			})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := a.Sign(pk, []byte("test data")); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		reader  string
+		slot    piv.Slot
+		wantErr error
+	}{
+		{"key", "", piv.SlotAuthentication, nil},
+		{"empty slot", "", piv.SlotSignature, ErrEmptySlot},
+		{"no YubiKey", "Some Other Reader", piv.SlotAuthentication, ErrNoYubiKey},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestAgent(t)
+			a.reader = tt.reader
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			yks, err := a.connectToYKs()
+			if err == nil {
+				a.setYKs(yks)
+				_, err = yks[0].publicKey(tt.slot)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, expected %v", err, tt.wantErr)
+			}
+			for _, sentinel := range []error{ErrEmptySlot, ErrNoYubiKey} {
+				if sentinel != tt.wantErr && errors.Is(err, sentinel) {
+					t.Errorf("error %v unexpectedly is %v", err, sentinel)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/go-piv/piv-go/piv"
+)
+
+// serveMetrics serves the -metrics-addr HTTP endpoint on l. It never returns.
+func (a *Agent) serveMetrics(l net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", a.metricsHandler)
+	log.Fatalln("Failed to serve metrics:", http.Serve(l, mux))
+}
+
+// metricsHandler writes the metrics in the Prometheus text exposition format.
+// It doesn't take a.mu, so it doesn't wait for signatures pending a touch.
+func (a *Agent) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "yubikey_agent_signatures_total", "counter",
+		"Signatures produced since the agent started.",
+		atomic.LoadUint64(&a.signatures))
+	writeMetric(w, "yubikey_agent_signature_errors_total", "counter",
+		"Signatures that failed since the agent started.",
+		atomic.LoadUint64(&a.signatureErrors))
+	writeMetric(w, "yubikey_agent_pin_prompts_total", "counter",
+		"Times the user was asked for a PIN since the agent started.",
+		atomic.LoadUint64(&a.pinPrompts))
+	writeMetric(w, "yubikey_agent_reconnects_total", "counter",
+		"Times the agent reconnected to the YubiKeys since it started.",
+		atomic.LoadUint64(&a.reconnects))
+
+	var present uint64
+	if a.mock != nil {
+		present = 1
+	} else if cards, err := piv.Cards(); err == nil && len(cards) > 0 {
+		present = 1
+	}
+	writeMetric(w, "yubikey_agent_yubikey_present", "gauge",
+		"Whether a smart card is plugged in.", present)
+
+	fmt.Fprintln(w, "# HELP yubikey_agent_yubikey_connected YubiKeys the agent has open, by serial number.")
+	fmt.Fprintln(w, "# TYPE yubikey_agent_yubikey_connected gauge")
+	serials, _ := a.connected.Load().([]uint32)
+	for _, serial := range serials {
+		fmt.Fprintf(w, "yubikey_agent_yubikey_connected{serial=\"%d\"} 1\n", serial)
+	}
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
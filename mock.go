@@ -0,0 +1,324 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/go-piv/piv-go/piv"
+)
+
+// The simulated YubiKey of -mock has this serial number and reader name, so
+// that -serial and -reader work as usual.
+const (
+	mockSerial = 10000000
+	mockReader = "Yubico YubiKey (simulated by yubikey-agent)"
+)
+
+// mockTouchDelay is how long the simulated YubiKey takes to be "touched".
+var mockTouchDelay = 1 * time.Second
+
+// mockYubiKey is a software YubiKey with in-memory keys, used instead of the
+// smart cards with -mock, to develop and test the agent without a device. It
+// implements pivDevice. Its keys are lost when the agent exits.
+//
+// It enforces the PIN and touch policies of its keys like a YubiKey would,
+// except that touches are simulated by waiting mockTouchDelay. Its
+// attestations can't chain to the Yubico root, so -mock implies
+// -no-attest-check.
+type mockYubiKey struct {
+	pin       string
+	retries   int
+	loggedIn  bool
+	lastTouch time.Time
+
+	managementKey [24]byte
+	metadata      *piv.Metadata
+
+	attestationKey  *ecdsa.PrivateKey
+	attestationCert *x509.Certificate
+
+	slots map[piv.Slot]*mockSlot
+
+	// failSigns are returned, one each, by the next signatures instead of
+	// signing, to simulate smart card errors.
+	failSigns []error
+}
+
+type mockSlot struct {
+	priv crypto.Signer
+	opts piv.Key
+	cert *x509.Certificate
+}
+
+// newMockYubiKey returns a simulated YubiKey with the factory PIN and PUK,
+// and a key in the Authentication slot generated like -setup does, with the
+// management key stored on the device.
+func newMockYubiKey() (*mockYubiKey, error) {
+	m := &mockYubiKey{}
+	if err := m.Reset(); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, m.managementKey[:]); err != nil {
+		return nil, err
+	}
+	key := m.managementKey
+	m.metadata = &piv.Metadata{ManagementKey: &key}
+	pub, err := m.GenerateKey(m.managementKey, piv.SlotAuthentication, piv.Key{
+		Algorithm:   piv.AlgorithmEC256,
+		PINPolicy:   piv.PINPolicyOnce,
+		TouchPolicy: piv.TouchPolicyAlways,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := storeCertificate(m, m.managementKey, piv.SlotAuthentication, pub); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// connectToMock is connectToYKs for -mock.
+func (a *Agent) connectToMock() ([]*yubiKey, error) {
+	if len(selectCards([]string{mockReader}, a.reader)) == 0 {
+		return nil, ErrNoYubiKey
+	}
+	if a.wantSerial != 0 && a.wantSerial != mockSerial {
+		return nil, fmt.Errorf("no YubiKey with serial number %d detected, found: #%d",
+			a.wantSerial, mockSerial)
+	}
+	return []*yubiKey{{
+		pivDevice:       a.mock,
+		serial:          mockSerial,
+		attestationCert: a.mock.attestationCert.Raw,
+	}}, nil
+}
+
+// Close ends the session, which like on a YubiKey forgets the PIN.
+func (m *mockYubiKey) Close() error {
+	m.loggedIn = false
+	return nil
+}
+
+func (m *mockYubiKey) Version() piv.Version {
+	return piv.Version{Major: 5, Minor: 7, Patch: 1}
+}
+
+func (m *mockYubiKey) Serial() (uint32, error) {
+	return mockSerial, nil
+}
+
+func (m *mockYubiKey) Retries() (int, error) {
+	return m.retries, nil
+}
+
+// Reset deletes the keys, and sets the PIN and PUK back to the defaults. The
+// attestation key is replaced, like a different YubiKey would have.
+func (m *mockYubiKey) Reset() error {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "yubikey-agent simulated PIV Attestation"},
+		SerialNumber: big.NewInt(mockSerial),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(42, 0, 0),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageCertSign,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, k.Public(), k)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	m.attestationKey, m.attestationCert = k, cert
+	m.pin, m.retries, m.loggedIn = piv.DefaultPIN, 3, false
+	m.managementKey = piv.DefaultManagementKey
+	m.metadata = nil
+	m.slots = make(map[piv.Slot]*mockSlot)
+	return nil
+}
+
+func (m *mockYubiKey) AttestationCertificate() (*x509.Certificate, error) {
+	return m.attestationCert, nil
+}
+
+// Attest fails for all keys, as there is no point in faking attestations that
+// can't be verified anyway. attest uses attestation instead.
+func (m *mockYubiKey) Attest(slot piv.Slot) (*x509.Certificate, error) {
+	if m.slots[slot] == nil {
+		return nil, fmt.Errorf("no key in slot %x: %w", slot.Key, piv.ErrNotFound)
+	}
+	return nil, errors.New("the simulated YubiKey doesn't support attestation")
+}
+
+// attestation returns what a verified attestation of the key in slot would
+// contain, so that the agent applies its PIN and touch policies.
+func (m *mockYubiKey) attestation(slot piv.Slot) (*piv.Attestation, error) {
+	s := m.slots[slot]
+	if s == nil || s.priv == nil {
+		return nil, fmt.Errorf("no key in slot %x: %w", slot.Key, piv.ErrNotFound)
+	}
+	return &piv.Attestation{
+		Version:     m.Version(),
+		Serial:      mockSerial,
+		Formfactor:  piv.FormfactorUSBCKeychain,
+		PINPolicy:   s.opts.PINPolicy,
+		TouchPolicy: s.opts.TouchPolicy,
+	}, nil
+}
+
+func (m *mockYubiKey) Certificate(slot piv.Slot) (*x509.Certificate, error) {
+	s := m.slots[slot]
+	if s == nil || s.cert == nil {
+		return nil, fmt.Errorf("no certificate in slot %x: %w", slot.Key, piv.ErrNotFound)
+	}
+	return s.cert, nil
+}
+
+func (m *mockYubiKey) SetCertificate(key [24]byte, slot piv.Slot, cert *x509.Certificate) error {
+	if key != m.managementKey {
+		return errors.New("authenticating with the management key failed")
+	}
+	s := m.slots[slot]
+	if s == nil {
+		s = &mockSlot{}
+		m.slots[slot] = s
+	}
+	s.cert = cert
+	return nil
+}
+
+func (m *mockYubiKey) GenerateKey(key [24]byte, slot piv.Slot, opts piv.Key) (crypto.PublicKey, error) {
+	if key != m.managementKey {
+		return nil, errors.New("authenticating with the management key failed")
+	}
+	var priv crypto.Signer
+	var err error
+	switch opts.Algorithm {
+	case piv.AlgorithmEC256:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case piv.AlgorithmEC384:
+		priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case piv.AlgorithmRSA1024:
+		priv, err = rsa.GenerateKey(rand.Reader, 1024)
+	case piv.AlgorithmRSA2048:
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %v", opts.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Like on a YubiKey, the old certificate is left in place.
+	s := m.slots[slot]
+	if s == nil {
+		s = &mockSlot{}
+		m.slots[slot] = s
+	}
+	s.priv, s.opts = priv, opts
+	return priv.Public(), nil
+}
+
+func (m *mockYubiKey) PrivateKey(slot piv.Slot, public crypto.PublicKey, auth piv.KeyAuth) (crypto.PrivateKey, error) {
+	s := m.slots[slot]
+	if s == nil || s.priv == nil {
+		return nil, fmt.Errorf("no key in slot %x: %w", slot.Key, piv.ErrNotFound)
+	}
+	return &mockPrivateKey{m: m, slot: s, auth: auth}, nil
+}
+
+func (m *mockYubiKey) Metadata(pin string) (*piv.Metadata, error) {
+	if err := m.verifyPIN(pin); err != nil {
+		return nil, err
+	}
+	if m.metadata == nil {
+		return &piv.Metadata{}, nil
+	}
+	return m.metadata, nil
+}
+
+// verifyPIN checks pin, counting down the retries like a YubiKey.
+func (m *mockYubiKey) verifyPIN(pin string) error {
+	if m.retries == 0 {
+		return piv.AuthErr{Retries: 0}
+	}
+	if pin != m.pin {
+		m.retries--
+		return piv.AuthErr{Retries: m.retries}
+	}
+	m.retries = 3
+	m.loggedIn = true
+	return nil
+}
+
+// mockPrivateKey is a key of the simulated YubiKey, which asks for the PIN
+// and waits for a touch when its policies require it.
+type mockPrivateKey struct {
+	m    *mockYubiKey
+	slot *mockSlot
+	auth piv.KeyAuth
+}
+
+func (k *mockPrivateKey) Public() crypto.PublicKey {
+	return k.slot.priv.Public()
+}
+
+func (k *mockPrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	// Like piv-go, only PKCS #1 v1.5 padding is supported for RSA.
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, errors.New("rsassa-pss signatures not supported")
+	}
+	if len(k.m.failSigns) > 0 {
+		err := k.m.failSigns[0]
+		k.m.failSigns = k.m.failSigns[1:]
+		return nil, err
+	}
+	if k.slot.opts.PINPolicy == piv.PINPolicyAlways ||
+		k.slot.opts.PINPolicy == piv.PINPolicyOnce && !k.m.loggedIn {
+		pin := k.auth.PIN
+		if pin == "" {
+			if k.auth.PINPrompt == nil {
+				return nil, errors.New("pin required but wasn't provided")
+			}
+			var err error
+			if pin, err = k.auth.PINPrompt(); err != nil {
+				return nil, fmt.Errorf("pin prompt: %w", err)
+			}
+		}
+		if err := k.m.verifyPIN(pin); err != nil {
+			return nil, err
+		}
+	}
+	// Cached touches last 15 seconds on a YubiKey.
+	if k.slot.opts.TouchPolicy == piv.TouchPolicyAlways ||
+		k.slot.opts.TouchPolicy == piv.TouchPolicyCached && time.Since(k.m.lastTouch) > 15*time.Second {
+		logEvent("debug", "touch", "Simulating a touch of the YubiKey", logFields{
+			"serial": mockSerial,
+		})
+		time.Sleep(mockTouchDelay)
+		k.m.lastTouch = time.Now()
+	}
+	return k.slot.priv.Sign(rand, digest, opts)
+}
@@ -0,0 +1,55 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-piv/piv-go/piv"
+)
+
+// TestMockPINRetries checks that the simulated YubiKey counts down and blocks
+// the PIN like a real one, since the agent relies on piv.AuthErr.
+func TestMockPINRetries(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		pins        []string
+		wantRetries int
+		wantErr     bool
+	}{
+		{"correct", []string{piv.DefaultPIN}, 3, false},
+		{"one wrong", []string{"000000"}, 2, true},
+		{"wrong then correct", []string{"000000", piv.DefaultPIN}, 3, false},
+		{"blocked", []string{"000000", "000000", "000000"}, 0, true},
+		{"blocked, then correct", []string{"000000", "000000", "000000", piv.DefaultPIN}, 0, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newMockYubiKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pin := range tt.pins {
+				_, err = m.Metadata(pin)
+			}
+			if tt.wantErr {
+				var authErr piv.AuthErr
+				if !errors.As(err, &authErr) {
+					t.Fatalf("got error %v, expected a piv.AuthErr", err)
+				}
+				if authErr.Retries != tt.wantRetries {
+					t.Errorf("got %d retries in the error, expected %d", authErr.Retries, tt.wantRetries)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if retries, _ := m.Retries(); retries != tt.wantRetries {
+				t.Errorf("got %d retries, expected %d", retries, tt.wantRetries)
+			}
+		})
+	}
+}
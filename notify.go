@@ -0,0 +1,117 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/go-piv/piv-go/piv"
+)
+
+// A notifier shows desktop notifications.
+type notifier interface {
+	// notify shows a notification, and returns a function that dismisses it,
+	// if the platform supports it.
+	notify(message string) (dismiss func())
+}
+
+// defaultNotifier returns the notifier for the current platform, or nil if
+// notifications are not supported.
+func defaultNotifier() notifier {
+	switch runtime.GOOS {
+	case "darwin":
+		return osascriptNotifier{}
+	case "linux":
+		return notifySendNotifier{}
+	}
+	return nil
+}
+
+type osascriptNotifier struct{}
+
+func (osascriptNotifier) notify(message string) func() {
+	message = strings.ReplaceAll(message, `\`, `\\`)
+	message = strings.ReplaceAll(message, `"`, `\"`)
+	appleScript := `display notification "%s" with title "yubikey-agent"`
+	exec.Command("osascript", "-e", fmt.Sprintf(appleScript, message)).Run()
+	// Notifications posted by osascript can't be dismissed.
+	return func() {}
+}
+
+type notifySendNotifier struct{}
+
+func (notifySendNotifier) notify(message string) func() {
+	out, err := exec.Command("notify-send", "--print-id",
+		"-i", "dialog-password", "yubikey-agent", message).Output()
+	if err != nil {
+		// Older versions of notify-send don't support --print-id.
+		exec.Command("notify-send", "-i", "dialog-password", "yubikey-agent", message).Run()
+		return func() {}
+	}
+	id := strings.TrimSpace(string(out))
+	return func() {
+		exec.Command("gdbus", "call", "--session",
+			"--dest", "org.freedesktop.Notifications",
+			"--object-path", "/org/freedesktop/Notifications",
+			"--method", "org.freedesktop.Notifications.CloseNotification", id).Run()
+	}
+}
+
+// armTouchNotification schedules a notification asking to touch the YubiKey
+// holding k, if its touch policy might require it. Keys that always require a
+// touch get the notification right away, while for keys with an unknown or
+// cached touch policy it's only shown if the signature is taking a while.
+func (a *Agent) armTouchNotification(k slotKey) {
+	if a.notifier == nil {
+		return
+	}
+	a.touchDelay = 5 * time.Second
+	if att, err := k.yk.attestation(k.slot); err == nil {
+		switch att.TouchPolicy {
+		case piv.TouchPolicyNever:
+			return
+		case piv.TouchPolicyAlways:
+			// A short delay still lets getPIN pause the notification if the
+			// PIN is needed before the touch.
+			a.touchDelay = 250 * time.Millisecond
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.touchCancel = cancel
+	// The goroutine gets its own reference to the timer, as the field is
+	// only safe to access while holding a.mu.
+	t := time.NewTimer(a.touchDelay)
+	a.touchNotification = t
+	n := a.notifier
+	go func() {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+		dismiss := n.notify("Waiting for YubiKey touch...")
+		<-ctx.Done()
+		dismiss()
+	}()
+}
+
+// disarmTouchNotification cancels the notification scheduled by
+// armTouchNotification, and dismisses it if it was shown.
+func (a *Agent) disarmTouchNotification() {
+	if a.touchCancel != nil {
+		a.touchCancel()
+	}
+	a.touchNotification = nil
+	a.touchCancel = nil
+}
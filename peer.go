@@ -0,0 +1,110 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/go-piv/piv-go/piv"
+)
+
+// peerRule is a -peer-slots rule, which allows the clients running as a user,
+// or as a member of a group, to use the keys in some slots.
+type peerRule struct {
+	uid, gid *uint32
+	slots    []piv.Slot
+}
+
+// parsePeerRule parses a -peer-slots value, like "uid:1000=9a", or
+// "group:deploy=9c,82". Users and groups can be given by ID or by name.
+func parsePeerRule(value string) (peerRule, error) {
+	i := strings.Index(value, "=")
+	j := strings.Index(value, ":")
+	if i < 0 || j < 0 || j > i {
+		return peerRule{}, fmt.Errorf("invalid -peer-slots %q, expected like uid:1000=9a", value)
+	}
+	kind, name, slotNames := value[:j], value[j+1:i], value[i+1:]
+
+	var r peerRule
+	switch kind {
+	case "uid", "user":
+		id := name
+		if kind == "user" {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return peerRule{}, err
+			}
+			id = u.Uid
+		}
+		uid, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return peerRule{}, fmt.Errorf("invalid user ID %q", id)
+		}
+		u32 := uint32(uid)
+		r.uid = &u32
+	case "gid", "group":
+		id := name
+		if kind == "group" {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return peerRule{}, err
+			}
+			id = g.Gid
+		}
+		gid, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return peerRule{}, fmt.Errorf("invalid group ID %q", id)
+		}
+		g32 := uint32(gid)
+		r.gid = &g32
+	default:
+		return peerRule{}, fmt.Errorf("invalid -peer-slots %q, expected uid, user, gid, or group", value)
+	}
+	for _, name := range strings.Split(slotNames, ",") {
+		slot, err := parseSlot(strings.TrimSpace(name))
+		if err != nil {
+			return peerRule{}, err
+		}
+		r.slots = append(r.slots, slot)
+	}
+	return r, nil
+}
+
+// peerSlots returns the slots the client on the other end of c can use
+// according to a.peerRules. If the client can't be identified, or no rule
+// matches it, the result is empty.
+func (a *Agent) peerSlots(c net.Conn) map[piv.Slot]bool {
+	slots := make(map[piv.Slot]bool)
+	uid, gid, err := peerIDs(c)
+	if err != nil {
+		logEvent("error", "error", "Can't identify the client for -peer-slots", logFields{
+			"error": err.Error(),
+		})
+		return slots
+	}
+	groups := map[uint32]bool{gid: true}
+	if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+		ids, _ := u.GroupIds()
+		for _, id := range ids {
+			if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+				groups[uint32(g)] = true
+			}
+		}
+	}
+	for _, r := range a.peerRules {
+		if r.uid != nil && *r.uid == uid || r.gid != nil && groups[*r.gid] {
+			for _, slot := range r.slots {
+				slots[slot] = true
+			}
+		}
+	}
+	return slots
+}
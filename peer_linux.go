@@ -0,0 +1,59 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// peerFields returns log fields identifying the process on the other end of
+// the UNIX socket connection c, using SO_PEERCRED. It's best-effort, and
+// returns no fields for other connection types or on error.
+func peerFields(c net.Conn) logFields {
+	cred, err := peerCred(c)
+	if err != nil {
+		return nil
+	}
+	fields := logFields{"pid": cred.Pid, "uid": cred.Uid}
+	if comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", cred.Pid)); err == nil {
+		fields["process"] = strings.TrimSpace(string(comm))
+	}
+	return fields
+}
+
+// peerIDs returns the user and group IDs of the process on the other end of
+// the UNIX socket connection c.
+func peerIDs(c net.Conn) (uid, gid uint32, err error) {
+	cred, err := peerCred(c)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cred.Uid, cred.Gid, nil
+}
+
+func peerCred(c net.Conn) (*syscall.Ucred, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a UNIX socket connection")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	if cerr := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); cerr != nil {
+		return nil, cerr
+	}
+	return cred, err
+}
@@ -0,0 +1,25 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// peerFields returns no fields, as SO_PEERCRED is only available on Linux.
+func peerFields(c net.Conn) logFields {
+	return nil
+}
+
+// peerIDs always fails, as SO_PEERCRED is only available on Linux.
+func peerIDs(c net.Conn) (uid, gid uint32, err error) {
+	return 0, 0, errors.New("peer credentials are only available on Linux")
+}
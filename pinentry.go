@@ -0,0 +1,203 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gopasspw/gopass/pkg/pinentry"
+	"golang.org/x/crypto/ssh"
+)
+
+// errConfirmationDenied is returned when the user doesn't confirm a signature.
+var errConfirmationDenied = errors.New("signature not confirmed by the user")
+
+// confirmSignature asks the user to confirm a signature with the key k.
+func (a *Agent) confirmSignature(k slotKey, session *sessionBinding) error {
+	if a.signTimer != nil && a.signTimer.Stop() {
+		defer a.signTimer.Reset(a.signTimeout)
+	}
+	desc := fmt.Sprintf("Allow signing with %s?\n\n%s",
+		a.keyComment(k.yk, k.slot), ssh.FingerprintSHA256(k.pk))
+	if session != nil {
+		desc += fmt.Sprintf("\n\nThe request is for the server with host key\n%s",
+			ssh.FingerprintSHA256(session.hostKey))
+	}
+	ok, err := pinentryConfirm("yubikey-agent Confirmation", desc)
+	if err != nil {
+		return fmt.Errorf("failed to ask for confirmation: %w", err)
+	}
+	if !ok {
+		return errConfirmationDenied
+	}
+	return nil
+}
+
+// pinentryBinary is the pinentry program, which can be changed with -pinentry.
+var pinentryBinary = pinentry.GetBinary()
+
+// pinentryTimeout, if not zero, is how long pinentry dialogs stay open, from
+// -pin-timeout. pinentryGrab, from -pin-ontop, asks pinentry to grab the
+// keyboard, which also keeps the dialog in front on most desktops.
+var (
+	pinentryTimeout time.Duration
+	pinentryGrab    bool
+)
+
+// pinentryConfirm shows a confirmation dialog with pinentry, and reports
+// whether the user accepted it.
+func pinentryConfirm(title, desc string) (bool, error) {
+	p, err := newPinentry()
+	if err != nil {
+		return false, err
+	}
+	defer p.Close()
+	for _, c := range []string{
+		"SETTITLE " + assuanEscape(title),
+		"SETDESC " + assuanEscape(desc),
+		"SETOK Allow",
+		"SETCANCEL Deny",
+	} {
+		if _, err := p.command(c); err != nil {
+			return false, err
+		}
+	}
+	_, err = p.command("CONFIRM")
+	var assuanErr assuanError
+	if errors.As(err, &assuanErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// pinentryClient speaks the Assuan protocol to a pinentry program. The
+// pinentry package can't use a different program, doesn't implement the
+// CONFIRM command correctly, and fails on status lines, so this is used
+// instead.
+type pinentryClient struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	r     *bufio.Reader
+}
+
+// newPinentry starts pinentryBinary, and reads its banner.
+func newPinentry() (*pinentryClient, error) {
+	cmd := exec.Command(pinentryBinary)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %q: %w", pinentryBinary, err)
+	}
+	p := &pinentryClient{cmd: cmd, stdin: stdin, r: bufio.NewReader(stdout)}
+	if _, err := p.response(); err != nil {
+		p.Close()
+		return nil, fmt.Errorf("failed to start %q: %w", pinentryBinary, err)
+	}
+	if pinentryTimeout > 0 {
+		// SETTIMEOUT takes whole seconds, and zero means no timeout.
+		secs := int((pinentryTimeout + time.Second - 1) / time.Second)
+		p.command(fmt.Sprintf("SETTIMEOUT %d", secs))
+	}
+	if pinentryGrab {
+		// Not all pinentry programs support this, so errors are ignored.
+		p.command("OPTION grab")
+	}
+	return p, nil
+}
+
+// Close ends the pinentry session and waits for the program to exit.
+func (p *pinentryClient) Close() {
+	p.stdin.Close()
+	p.cmd.Wait()
+}
+
+// assuanError is an ERR response, like the one returned when the user cancels
+// a dialog.
+type assuanError string
+
+func (e assuanError) Error() string {
+	return "pinentry error: " + string(e)
+}
+
+// command sends c, and returns the data of the response.
+func (p *pinentryClient) command(c string) ([]byte, error) {
+	if _, err := fmt.Fprintf(p.stdin, "%s\n", c); err != nil {
+		return nil, err
+	}
+	return p.response()
+}
+
+// set sends a SET command, like SETDESC for name "desc". Errors are ignored,
+// as pinentry programs don't all support the same settings.
+func (p *pinentryClient) set(name, value string) {
+	p.command("SET" + strings.ToUpper(name) + " " + assuanEscape(value))
+}
+
+// response reads lines until OK or ERR, and returns the decoded data of any D
+// lines. Status and comment lines are ignored.
+func (p *pinentryClient) response() ([]byte, error) {
+	var data []byte
+	for {
+		line, err := p.r.ReadBytes('\n')
+		if err != nil {
+			zeroBytes(data)
+			return nil, err
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		switch {
+		case bytes.Equal(line, []byte("OK")) || bytes.HasPrefix(line, []byte("OK ")):
+			return data, nil
+		case bytes.HasPrefix(line, []byte("ERR ")):
+			zeroBytes(data)
+			return nil, assuanError(bytes.TrimPrefix(line, []byte("ERR ")))
+		case bytes.HasPrefix(line, []byte("D ")):
+			// The data is usually a PIN, so don't leave copies around.
+			data = append(data, assuanUnescape(bytes.TrimPrefix(line, []byte("D ")))...)
+			zeroBytes(line)
+		case bytes.HasPrefix(line, []byte("S ")) || bytes.HasPrefix(line, []byte("#")):
+		default:
+			zeroBytes(data)
+			return nil, fmt.Errorf("unexpected response from pinentry: %q", line)
+		}
+	}
+}
+
+// assuanEscape percent-encodes the characters that can't appear in an Assuan
+// command parameter.
+func assuanEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// assuanUnescape decodes the percent-encoding of Assuan data lines.
+func assuanUnescape(s []byte) []byte {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if v, err := strconv.ParseUint(string(s[i+1:i+3]), 16, 8); err == nil {
+				b = append(b, byte(v))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// pinHelperRequest is the first line sent to a -pin-helper-socket, as JSON.
+type pinHelperRequest struct {
+	Title  string `json:"title"`
+	Desc   string `json:"desc"`
+	Error  string `json:"error,omitempty"`
+	Serial uint32 `json:"serial"`
+}
+
+// readPINFromHelper asks for a PIN through the helper listening on the socket
+// at path. The agent sends a pinHelperRequest as a JSON line, and the helper
+// replies with a single line, "OK " followed by the PIN, or "CANCEL", and
+// then the connection is closed. The PIN is read as raw bytes, and not as
+// JSON, so it can be zeroed after use.
+func readPINFromHelper(path string, serial uint32, desc, errMsg string) ([]byte, error) {
+	c, err := dial(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the PIN helper: %w", err)
+	}
+	defer c.Close()
+	req, err := json.Marshal(pinHelperRequest{
+		Title:  "yubikey-agent PIN Prompt",
+		Desc:   desc,
+		Error:  errMsg,
+		Serial: serial,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(append(req, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to send the request to the PIN helper: %w", err)
+	}
+	line, err := bufio.NewReader(c).ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the PIN helper response: %w", err)
+	}
+	line = bytes.TrimRight(line, "\r\n")
+	switch {
+	case bytes.HasPrefix(line, []byte("OK ")):
+		pin := append([]byte(nil), line[len("OK "):]...)
+		zeroBytes(line)
+		return pin, nil
+	case bytes.Equal(line, []byte("CANCEL")):
+		return nil, errors.New("PIN entry canceled")
+	default:
+		zeroBytes(line)
+		return nil, errors.New("malformed PIN helper response")
+	}
+}
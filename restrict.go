@@ -0,0 +1,354 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// destinationConstraint allows signatures for the hop from one host to another,
+// as in the restrict-destination-v00@openssh.com key constraint that ssh-add -h
+// sets. They come from -destination for all connections, or from the extension
+// of the same name for one connection. See PROTOCOL.agent in OpenSSH.
+type destinationConstraint struct {
+	from, to destinationHop
+}
+
+// destinationHop is one end of a destinationConstraint. A from hop with an
+// empty hostname and no keys is the origin, that is, the local machine.
+type destinationHop struct {
+	user     string
+	hostname string
+	keys     []destinationKey
+}
+
+type destinationKey struct {
+	key  ssh.PublicKey
+	isCA bool
+}
+
+// restrictDestinationExtension implements the
+// restrict-destination-v00@openssh.com extension. The contents are encoded
+// like the key constraint of the same name, and apply to all keys for the rest
+// of the connection, in addition to -destination. They can't be changed once
+// set.
+func (c *connAgent) restrictDestinationExtension(contents []byte) ([]byte, error) {
+	if c.constraints != nil {
+		return nil, errors.New("destination constraints already set")
+	}
+	constraints, err := parseDestinationConstraints(contents)
+	if err != nil {
+		return nil, fmt.Errorf("malformed restrict-destination request: %w", err)
+	}
+	if len(constraints) == 0 {
+		return nil, errors.New("empty destination constraints")
+	}
+	c.constraints = constraints
+	return []byte{agentSuccess}, nil
+}
+
+func parseDestinationConstraints(contents []byte) ([]destinationConstraint, error) {
+	var req struct {
+		Constraints []byte
+	}
+	if err := ssh.Unmarshal(contents, &req); err != nil {
+		return nil, err
+	}
+	var constraints []destinationConstraint
+	for rest := req.Constraints; len(rest) > 0; {
+		var next struct {
+			Constraint []byte
+			Rest       []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(rest, &next); err != nil {
+			return nil, err
+		}
+		rest = next.Rest
+		var dc struct {
+			From, To, Reserved []byte
+		}
+		if err := ssh.Unmarshal(next.Constraint, &dc); err != nil {
+			return nil, err
+		}
+		from, err := parseDestinationHop(dc.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseDestinationHop(dc.To)
+		if err != nil {
+			return nil, err
+		}
+		if from.user != "" {
+			return nil, errors.New("from username must be empty")
+		}
+		if from.hostname == "" && len(from.keys) > 0 {
+			return nil, errors.New("origin hop can't have keys")
+		}
+		if from.hostname != "" && len(from.keys) == 0 {
+			return nil, errors.New("from hop needs keys")
+		}
+		if to.hostname == "" || len(to.keys) == 0 {
+			return nil, errors.New("destination hop needs a hostname and keys")
+		}
+		constraints = append(constraints, destinationConstraint{from: from, to: to})
+	}
+	return constraints, nil
+}
+
+func parseDestinationHop(b []byte) (destinationHop, error) {
+	var hop struct {
+		User     string
+		Hostname string
+		Reserved []byte
+		Keys     []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(b, &hop); err != nil {
+		return destinationHop{}, err
+	}
+	h := destinationHop{user: hop.User, hostname: hop.Hostname}
+	for rest := hop.Keys; len(rest) > 0; {
+		var k struct {
+			KeyBlob []byte
+			IsCA    bool
+			Rest    []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(rest, &k); err != nil {
+			return destinationHop{}, err
+		}
+		rest = k.Rest
+		key, err := ssh.ParsePublicKey(k.KeyBlob)
+		if err != nil {
+			return destinationHop{}, err
+		}
+		h.keys = append(h.keys, destinationKey{key: key, isCA: k.IsCA})
+	}
+	return h, nil
+}
+
+// knownHostsFiles are where -destination looks up host keys, like ssh does by
+// default. "~" is the home directory.
+var knownHostsFiles = []string{"~/.ssh/known_hosts", "~/.ssh/known_hosts2", "/etc/ssh/ssh_known_hosts"}
+
+// parseDestination parses a -destination, like ssh-add -h does. It's either
+// [user@]host, which allows the hop from the local machine to host, or
+// from>[user@]host, which allows the hop from the host from to host, for
+// example through a forwarded agent. The host keys are read from the
+// knownHostsFiles, including @cert-authority lines.
+func parseDestination(value string) (destinationConstraint, error) {
+	var dc destinationConstraint
+	toSpec := value
+	if i := strings.Index(value, ">"); i >= 0 {
+		fromHost := value[:i]
+		toSpec = value[i+1:]
+		if fromHost == "" || strings.Contains(fromHost, "@") {
+			return dc, fmt.Errorf("invalid -destination %q, the first host can't have a user", value)
+		}
+		keys, err := lookupHostKeys(fromHost)
+		if err != nil {
+			return dc, err
+		}
+		dc.from = destinationHop{hostname: fromHost, keys: keys}
+	}
+	if i := strings.LastIndex(toSpec, "@"); i >= 0 {
+		dc.to.user, toSpec = toSpec[:i], toSpec[i+1:]
+	}
+	if toSpec == "" || strings.Contains(toSpec, ">") {
+		return dc, fmt.Errorf("invalid -destination %q, expected [user@]host or from>[user@]host", value)
+	}
+	keys, err := lookupHostKeys(toSpec)
+	if err != nil {
+		return dc, err
+	}
+	dc.to.hostname, dc.to.keys = toSpec, keys
+	return dc, nil
+}
+
+// lookupHostKeys returns the keys of host in the knownHostsFiles.
+func lookupHostKeys(host string) ([]destinationKey, error) {
+	var keys []destinationKey
+	for _, name := range knownHostsFiles {
+		if strings.HasPrefix(name, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				continue
+			}
+			name = filepath.Join(home, name[2:])
+		}
+		data, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for len(data) > 0 {
+			var marker string
+			var hosts []string
+			var key ssh.PublicKey
+			marker, hosts, key, _, data, err = ssh.ParseKnownHosts(data)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+			}
+			if marker == "revoked" || !matchKnownHost(hosts, host) {
+				continue
+			}
+			keys = append(keys, destinationKey{key: key, isCA: marker == "cert-authority"})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no host keys for %q in %s", host, strings.Join(knownHostsFiles, ", "))
+	}
+	return keys, nil
+}
+
+// matchKnownHost reports whether host matches the host patterns of a
+// known_hosts line, which can be hashed, use * and ? wildcards, or be negated
+// with !.
+func matchKnownHost(patterns []string, host string) bool {
+	matched := false
+	for _, p := range patterns {
+		negated := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		var ok bool
+		if strings.HasPrefix(p, "|1|") {
+			ok = matchHashedHost(p, host)
+		} else {
+			ok = p == host
+			if !ok && strings.ContainsAny(p, "*?") {
+				ok, _ = path.Match(p, host)
+			}
+		}
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// matchHashedHost reports whether the hashed known_hosts entry "|1|salt|hash"
+// is for host, see HashKnownHosts in ssh_config(5).
+func matchHashedHost(entry, host string) bool {
+	parts := strings.Split(entry, "|")
+	if len(parts) != 4 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// matchKey reports whether the host key hostKey belongs to the hop, either
+// directly or through a host certificate signed by one of the hop CA keys.
+func (h destinationHop) matchKey(hostKey ssh.PublicKey) bool {
+	for _, k := range h.keys {
+		if !k.isCA {
+			if bytes.Equal(k.key.Marshal(), hostKey.Marshal()) {
+				return true
+			}
+			continue
+		}
+		cert, ok := hostKey.(*ssh.Certificate)
+		if ok && cert.CertType == ssh.HostCert &&
+			bytes.Equal(cert.SignatureKey.Marshal(), k.key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDestination rejects signature requests that are not allowed by the
+// -destination constraints, or by those the connection set with
+// restrict-destination-v00@openssh.com. Both apply if both are set.
+func (c *connAgent) checkDestination(data []byte) error {
+	c.mu.Lock()
+	destinations := c.destinations
+	c.mu.Unlock()
+	if err := checkDestinations(destinations, c.sessions, data); err != nil {
+		return err
+	}
+	return checkDestinations(c.constraints, c.sessions, data)
+}
+
+// checkDestinations checks a signature request for data on a connection bound
+// to sessions against destinations, if not nil. Every hop in the chain of
+// session bindings must be allowed by a constraint, and the request must be a
+// user authentication for the last one. Without session bindings the request
+// is local, and is allowed, like by ssh-agent. The bindings are made by the
+// ssh client, including for connections forwarded to other hosts, so those
+// can't get around them by opening a new connection.
+func checkDestinations(destinations []destinationConstraint, sessions []sessionBinding, data []byte) error {
+	if destinations == nil || len(sessions) == 0 {
+		return nil
+	}
+	last := sessions[len(sessions)-1]
+	if last.forwarding {
+		return errors.New("destination constrained keys can't be used in a forwarded session")
+	}
+	_, user, ok := parseUserAuthRequest(data)
+	if !ok {
+		return errors.New("destination constrained keys can only be used for user authentication")
+	}
+	var from ssh.PublicKey
+	for i, s := range sessions {
+		u := ""
+		if i == len(sessions)-1 {
+			u = user
+		}
+		if !permitted(destinations, from, s.hostKey, u) {
+			return fmt.Errorf("signature request for host key %s not permitted by the destination constraints",
+				ssh.FingerprintSHA256(s.hostKey))
+		}
+		from = s.hostKey
+	}
+	return nil
+}
+
+// permitted reports whether one of destinations allows the hop from the host
+// with key from (or the origin, if nil) to the host with key to, as user.
+func permitted(destinations []destinationConstraint, from, to ssh.PublicKey, user string) bool {
+	for _, dc := range destinations {
+		if from == nil && dc.from.hostname != "" {
+			continue
+		}
+		if from != nil && !dc.from.matchKey(from) {
+			continue
+		}
+		if !dc.to.matchKey(to) {
+			continue
+		}
+		if user != "" && dc.to.user != "" && dc.to.user != user {
+			continue
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRestrictDestinationExtension(t *testing.T) {
+	newHostKey := func() ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	jump, host, other := newHostKey(), newHostKey(), newHostKey()
+
+	hop := func(user, hostname string, keys ...ssh.PublicKey) []byte {
+		b := ssh.Marshal(struct {
+			User, Hostname string
+			Reserved       []byte
+		}{user, hostname, nil})
+		for _, k := range keys {
+			b = append(b, ssh.Marshal(struct {
+				KeyBlob []byte
+				IsCA    bool
+			}{k.Marshal(), false})...)
+		}
+		return b
+	}
+	constraint := func(from, to []byte) []byte {
+		return ssh.Marshal(struct {
+			Constraint []byte
+		}{ssh.Marshal(struct{ From, To, Reserved []byte }{from, to, nil})})
+	}
+	extension := func(constraints ...[]byte) []byte {
+		var b []byte
+		for _, c := range constraints {
+			b = append(b, c...)
+		}
+		return ssh.Marshal(struct{ Constraints []byte }{b})
+	}
+	userAuth := func(user string) []byte {
+		return ssh.Marshal(struct {
+			SessionID             []byte
+			Type                  uint8
+			User, Service, Method string
+		}{[]byte("session"), 50, user, "ssh-connection", "publickey"})
+	}
+
+	direct := extension(constraint(hop("", ""), hop("", "host", host)))
+	viaJump := extension(
+		constraint(hop("", ""), hop("", "jump", jump)),
+		constraint(hop("", "jump", jump), hop("alice", "host", host)))
+	for _, tt := range []struct {
+		name     string
+		contents []byte
+		sessions []ssh.PublicKey
+		data     []byte
+		wantErr  bool // from the extension
+		allowed  bool
+	}{
+		{"direct", direct, []ssh.PublicKey{host}, userAuth("alice"), false, true},
+		{"direct, other host", direct, []ssh.PublicKey{other}, userAuth("alice"), false, false},
+		{"direct, not user auth", direct, []ssh.PublicKey{host}, []byte("data"), false, false},
+		{"local", direct, nil, []byte("data"), false, true},
+		{"jump", viaJump, []ssh.PublicKey{jump, host}, userAuth("alice"), false, true},
+		{"jump, wrong user", viaJump, []ssh.PublicKey{jump, host}, userAuth("bob"), false, false},
+		{"jump, skipped", viaJump, []ssh.PublicKey{host}, userAuth("alice"), false, false},
+		{"empty", extension(), nil, nil, true, false},
+		{"malformed", []byte("malformed"), nil, nil, true, false},
+		{"origin with keys", extension(constraint(hop("", "", jump), hop("", "host", host))), nil, nil, true, false},
+		{"destination without keys", extension(constraint(hop("", ""), hop("", "host"))), nil, nil, true, false},
+		{"from user", extension(constraint(hop("alice", "jump", jump), hop("", "host", host))), nil, nil, true, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestAgent(t)
+			c := &connAgent{Agent: a}
+			for _, k := range tt.sessions {
+				c.sessions = append(c.sessions, sessionBinding{hostKey: k})
+			}
+			_, err := c.Extension("restrict-destination-v00@openssh.com", tt.contents)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("extension succeeded, expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.Extension("restrict-destination-v00@openssh.com", tt.contents); err == nil {
+				t.Error("constraints were set twice")
+			}
+			err = c.checkDestination(tt.data)
+			if tt.allowed && err != nil {
+				t.Errorf("got error %v, expected the signature to be allowed", err)
+			} else if !tt.allowed && err == nil {
+				t.Error("signature allowed, expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/go-piv/piv-go/piv"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// connAgent is the Agent as seen by a single client connection. It keeps the
+// state that is specific to the connection, like session bindings.
+type connAgent struct {
+	*Agent
+
+	// sessions are the sessions the connection was bound to with the
+	// session-bind@openssh.com extension, in order.
+	sessions []sessionBinding
+
+	// peer describes the client, for logging.
+	peer logFields
+
+	// signed is set after the -once signature was made on this connection.
+	signed bool
+
+	// slots, if not nil, are the only slots the client is allowed to use,
+	// according to -peer-slots.
+	slots map[piv.Slot]bool
+
+	// constraints are the destination constraints set with the
+	// restrict-destination-v00@openssh.com extension, if any, which apply
+	// in addition to -destination.
+	constraints []destinationConstraint
+
+	// foreign is set if the client runs as another user than the agent, which
+	// -allow-uid or -peer-slots let in. Such clients can use the keys, but
+	// not manage the agent.
+	foreign bool
+}
+
+// errForeignPeer is returned when a client running as another user tries to
+// manage the agent, see connAgent.foreign.
+var errForeignPeer = errors.New("only the user running the agent can do this")
+
+var _ agent.ExtendedAgent = &connAgent{}
+
+type sessionBinding struct {
+	hostKey    ssh.PublicKey
+	sessionID  []byte
+	forwarding bool
+
+	// used is set after the first signature for the session is logged.
+	used bool
+}
+
+// maxSessionBindings is the maximum number of sessions a connection can be
+// bound to, matching AGENT_MAX_SESSION_IDS in OpenSSH.
+const maxSessionBindings = 16
+
+// sessionBindExtension implements the session-bind@openssh.com extension,
+// which binds the connection to an SSH session, identified by its session ID
+// and signed by the server host key. See PROTOCOL.agent in OpenSSH.
+func (c *connAgent) sessionBindExtension(contents []byte) ([]byte, error) {
+	var req struct {
+		HostKey    []byte
+		SessionID  []byte
+		Signature  []byte
+		Forwarding bool
+	}
+	if err := ssh.Unmarshal(contents, &req); err != nil {
+		return nil, fmt.Errorf("malformed session-bind request: %w", err)
+	}
+	hostKey, err := ssh.ParsePublicKey(req.HostKey)
+	if err != nil {
+		return nil, fmt.Errorf("malformed session-bind host key: %w", err)
+	}
+	sig := new(ssh.Signature)
+	if err := ssh.Unmarshal(req.Signature, sig); err != nil {
+		return nil, fmt.Errorf("malformed session-bind signature: %w", err)
+	}
+	if err := hostKey.Verify(req.SessionID, sig); err != nil {
+		return nil, fmt.Errorf("invalid session-bind signature: %w", err)
+	}
+
+	for _, s := range c.sessions {
+		if !s.forwarding {
+			return nil, errors.New("connection already bound for authentication")
+		}
+		if bytes.Equal(s.sessionID, req.SessionID) {
+			if bytes.Equal(s.hostKey.Marshal(), hostKey.Marshal()) {
+				return []byte{agentSuccess}, nil
+			}
+			return nil, errors.New("session ID already bound to a different host key")
+		}
+	}
+	if len(c.sessions) >= maxSessionBindings {
+		return nil, errors.New("too many session bindings")
+	}
+	c.sessions = append(c.sessions, sessionBinding{
+		hostKey:    hostKey,
+		sessionID:  req.SessionID,
+		forwarding: req.Forwarding,
+	})
+	return []byte{agentSuccess}, nil
+}
+
+func (c *connAgent) List() ([]*agent.Key, error) {
+	return c.list(c.slots)
+}
+
+// Lock and Unlock are refused to foreign clients, which could otherwise lock
+// the owner out of the agent with a passphrase only they know.
+func (c *connAgent) Lock(passphrase []byte) error {
+	if c.foreign {
+		logEvent("warning", "reject", "Refused to lock the agent for another user", c.peer)
+		return errForeignPeer
+	}
+	return c.Agent.Lock(passphrase)
+}
+
+func (c *connAgent) Unlock(passphrase []byte) error {
+	if c.foreign {
+		logEvent("warning", "reject", "Refused to unlock the agent for another user", c.peer)
+		return errForeignPeer
+	}
+	return c.Agent.Unlock(passphrase)
+}
+
+func (c *connAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return c.SignWithFlags(key, data, 0)
+}
+
+func (c *connAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if err := c.checkSession(data); err != nil {
+		return nil, err
+	}
+	if err := c.checkDestination(data); err != nil {
+		return nil, err
+	}
+	var session *sessionBinding
+	if len(c.sessions) > 0 {
+		session = &c.sessions[len(c.sessions)-1]
+	}
+	if c.once {
+		// Reserve the only signature, and release it if this one fails.
+		if !atomic.CompareAndSwapUint32(&c.onceUsed, 0, 1) {
+			return nil, errors.New("the -once signature was already made")
+		}
+	}
+	sig, err := c.sign(key, data, flags, session, c.slots)
+	if c.once {
+		switch {
+		case errors.Is(err, errSignTimeout):
+			// The abandoned signature might still be made after a late
+			// touch, so it counts as the only one, and the agent exits
+			// when this connection ends like after a successful one.
+			c.signed = true
+		case err != nil:
+			atomic.StoreUint32(&c.onceUsed, 0)
+		default:
+			c.signed = true
+		}
+	}
+	if err == nil && c.audit != nil {
+		c.audit.record(key, data, sig, c.peer)
+	}
+	if err == nil && session != nil && !session.used {
+		// Log which host the connection is bound to the first time it's used,
+		// to trace back which remote host caused a signature through a
+		// forwarded agent.
+		session.used = true
+		logEvent("info", "session", "Signature for a bound session", logFields{
+			"host_key":    ssh.FingerprintSHA256(session.hostKey),
+			"forwarding":  session.forwarding,
+			"hops":        len(c.sessions),
+			"fingerprint": ssh.FingerprintSHA256(key),
+		})
+	}
+	return sig, err
+}
+
+// checkSession rejects user authentication requests for a session other than
+// the one the connection was bound to for authentication, if any.
+func (c *connAgent) checkSession(data []byte) error {
+	if len(c.sessions) == 0 {
+		return nil
+	}
+	last := c.sessions[len(c.sessions)-1]
+	if last.forwarding {
+		return nil
+	}
+	sessionID, _, ok := parseUserAuthRequest(data)
+	if !ok {
+		return nil
+	}
+	if !bytes.Equal(sessionID, last.sessionID) {
+		return errors.New("signature request for a session other than the bound one")
+	}
+	return nil
+}
+
+// parseUserAuthRequest returns the session ID and user name of a publickey
+// SSH_MSG_USERAUTH_REQUEST being signed, as specified in RFC 4252, Section 7.
+func parseUserAuthRequest(data []byte) (sessionID []byte, user string, ok bool) {
+	const msgUserAuthRequest = 50
+	var req struct {
+		SessionID []byte
+		Type      uint8
+		User      string
+		Service   string
+		Method    string
+		Rest      []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(data, &req); err != nil || req.Type != msgUserAuthRequest {
+		return nil, "", false
+	}
+	switch req.Method {
+	case "publickey", "publickey-hostbound-v00@openssh.com":
+		return req.SessionID, req.User, true
+	default:
+		return nil, "", false
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-piv/piv-go/piv"
+)
+
+func TestOnce(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		touchDelay time.Duration
+		failSign   error
+		firstOK    bool
+		secondOK   bool
+	}{
+		{"signed", 0, nil, true, false},
+		{"failed", 0, errors.New("smart card error 6a80"), false, true},
+		// The YubiKey is touched after the timeout, and signs anyway.
+		{"timed out", 500 * time.Millisecond, nil, false, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, m := newTestAgent(t)
+			a.once = true
+			a.onceDone = make(chan struct{})
+			a.signTimeout = 100 * time.Millisecond
+			pk := addMockKey(t, m, piv.SlotSignature, piv.Key{
+				Algorithm:   piv.AlgorithmEC256,
+				PINPolicy:   piv.PINPolicyNever,
+				TouchPolicy: piv.TouchPolicyAlways,
+			})
+			mockTouchDelay = tt.touchDelay
+			if tt.failSign != nil {
+				m.failSigns = []error{tt.failSign}
+			}
+
+			first := &connAgent{Agent: a}
+			_, err := first.Sign(pk, []byte("test data"))
+			if tt.firstOK && err != nil {
+				t.Fatalf("first signature failed: %v", err)
+			} else if !tt.firstOK && err == nil {
+				t.Fatal("first signature succeeded, expected an error")
+			}
+
+			// Wait for the abandoned signature to finish, and let the next
+			// one take as long as it needs.
+			a.mu.Lock()
+			a.signTimeout = 0
+			mockTouchDelay = 0
+			a.mu.Unlock()
+
+			second := &connAgent{Agent: a}
+			_, err = second.Sign(pk, []byte("test data"))
+			if tt.secondOK && err != nil {
+				t.Errorf("second signature failed: %v", err)
+			} else if !tt.secondOK && err == nil {
+				t.Error("second signature succeeded, expected only one")
+			}
+		})
+	}
+}
@@ -7,18 +7,24 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"os"
+	"runtime"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-piv/piv-go/piv"
@@ -42,30 +48,89 @@ func init() {
 	Version = "(unknown version)"
 }
 
-func connectForSetup() *piv.YubiKey {
+// runVersion prints the version of yubikey-agent and of the relevant parts of
+// its build, for bug reports.
+func runVersion() {
+	fmt.Printf("yubikey-agent %s\n", Version)
+	fmt.Printf("Go %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range buildInfo.Deps {
+			if dep.Path == "github.com/go-piv/piv-go" {
+				fmt.Printf("piv-go %s\n", dep.Version)
+			}
+		}
+	}
+}
+
+func connectForSetup(reader string) *piv.YubiKey {
 	cards, err := piv.Cards()
 	if err != nil {
 		log.Fatalln("Failed to enumerate tokens:", err)
 	}
+	cards = selectCards(cards, reader)
 	if len(cards) == 0 {
 		log.Fatalln("No YubiKeys detected!")
 	}
 	// TODO: support multiple YubiKeys.
 	yk, err := piv.Open(cards[0])
 	if err != nil {
-		log.Fatalln("Failed to connect to the YubiKey:", err)
+		log.Fatalln("Failed to connect to the YubiKey:", explainOpenError(err))
 	}
 	return yk
 }
 
-func runReset(yk *piv.YubiKey) {
+func runReset(yk pivDevice) {
 	fmt.Println("Resetting YubiKey PIV applet...")
 	if err := yk.Reset(); err != nil {
 		log.Fatalln("Failed to reset YubiKey:", err)
 	}
 }
 
-func runSetup(yk *piv.YubiKey) {
+// runResetCommand implements -reset. It wipes the PIV applet of the YubiKey,
+// after the user confirms by typing its serial number.
+func runResetCommand(a *Agent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.ensureYK(); err != nil {
+		log.Fatalln("Failed to connect to the YubiKey:", err)
+	}
+	defer a.closeYKs()
+	if len(a.yks) != 1 {
+		log.Fatalln("Multiple YubiKeys detected, select one with -serial.")
+	}
+	yk := a.yks[0]
+
+	fmt.Printf("‼️  This will delete all PIV keys and certificates on YubiKey #%d,\n", yk.serial)
+	fmt.Println("and reset its PIN, PUK, and Management Key to the defaults.")
+	fmt.Println("")
+	fmt.Print("To confirm, type the serial number of the YubiKey: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatalln("Failed to read confirmation:", err)
+	}
+	if strings.TrimSpace(line) != strconv.FormatUint(uint64(yk.serial), 10) {
+		log.Fatalln("The serial number doesn't match, not resetting.")
+	}
+
+	runReset(yk.pivDevice)
+	fmt.Println("")
+	fmt.Println("✅ Done! The PIV applet was reset to the factory defaults:")
+	fmt.Println("")
+	fmt.Printf("\tPIN: %s\n", piv.DefaultPIN)
+	fmt.Printf("\tPUK: %s\n", piv.DefaultPUK)
+	fmt.Printf("\tManagement Key: %x\n", piv.DefaultManagementKey)
+	fmt.Println("")
+	fmt.Println("Run yubikey-agent -setup to generate a new key and set a PIN.")
+}
+
+// setupAlgorithms are the key algorithms that can be selected with -algo.
+var setupAlgorithms = map[string]piv.Algorithm{
+	"ec256":   piv.AlgorithmEC256,
+	"ec384":   piv.AlgorithmEC384,
+	"rsa2048": piv.AlgorithmRSA2048,
+}
+
+func runSetup(yk *piv.YubiKey, alg piv.Algorithm) {
 	if _, err := yk.Certificate(piv.SlotAuthentication); err == nil {
 		log.Println("‼️  This YubiKey looks already setup")
 		log.Println("")
@@ -78,23 +143,11 @@ func runSetup(yk *piv.YubiKey) {
 	fmt.Println("🔐 The PIN is up to 8 numbers, letters, or symbols. Not just numbers!")
 	fmt.Println("❌ The key will be lost if the PIN and PUK are locked after 3 incorrect tries.")
 	fmt.Println("")
-	fmt.Print("Choose a new PIN/PUK: ")
-	pin, err := terminal.ReadPassword(int(os.Stdin.Fd()))
-	fmt.Print("\n")
-	if err != nil {
-		log.Fatalln("Failed to read PIN:", err)
-	}
+	pin := readNewPIN()
+	defer zeroBytes(pin)
 	if len(pin) == 0 || len(pin) > 8 {
 		log.Fatalln("The PIN needs to be 1-8 characters.")
 	}
-	fmt.Print("Repeat PIN/PUK: ")
-	repeat, err := terminal.ReadPassword(int(os.Stdin.Fd()))
-	fmt.Print("\n")
-	if err != nil {
-		log.Fatalln("Failed to read PIN:", err)
-	} else if !bytes.Equal(repeat, pin) {
-		log.Fatalln("PINs don't match!")
-	}
 
 	fmt.Println("")
 	fmt.Println("🧪 Reticulating splines...")
@@ -137,7 +190,7 @@ func runSetup(yk *piv.YubiKey) {
 	}
 
 	pub, err := yk.GenerateKey(key, piv.SlotAuthentication, piv.Key{
-		Algorithm:   piv.AlgorithmEC256,
+		Algorithm:   alg,
 		PINPolicy:   piv.PINPolicyOnce,
 		TouchPolicy: piv.TouchPolicyAlways,
 	})
@@ -145,9 +198,34 @@ func runSetup(yk *piv.YubiKey) {
 		log.Fatalln("Failed to generate key:", err)
 	}
 
+	if err := storeCertificate(yk, key, piv.SlotAuthentication, pub); err != nil {
+		log.Fatalln(err)
+	}
+
+	sshKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		log.Fatalln("Failed to generate public key:", err)
+	}
+
+	fmt.Println("")
+	fmt.Println("✅ Done! This YubiKey is secured and ready to go.")
+	fmt.Println("🤏 When the YubiKey blinks, touch it to authorize the login.")
+	fmt.Println("")
+	fmt.Println("🔑 Here's your new shiny SSH public key:")
+	os.Stdout.Write(ssh.MarshalAuthorizedKey(sshKey))
+	fmt.Println("")
+	fmt.Println("Next steps: ensure yubikey-agent is running via launchd/systemd/...,")
+	fmt.Println(`set the SSH_AUTH_SOCK environment variable, and test with "ssh-add -L"`)
+	fmt.Println("")
+	fmt.Println("💭 Remember: everything breaks, have a backup plan for when this YubiKey does.")
+}
+
+// storeCertificate stores in slot a self-signed certificate for pub, which
+// lets the key be found, since PIV doesn't allow reading public keys back.
+func storeCertificate(yk pivDevice, key [24]byte, slot piv.Slot, pub crypto.PublicKey) error {
 	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		log.Fatalln("Failed to generate parent key:", err)
+		return fmt.Errorf("failed to generate parent key: %w", err)
 	}
 	parent := &x509.Certificate{
 		Subject: pkix.Name{
@@ -167,32 +245,170 @@ func runSetup(yk *piv.YubiKey) {
 	}
 	certBytes, err := x509.CreateCertificate(rand.Reader, template, parent, pub, priv)
 	if err != nil {
-		log.Fatalln("Failed to generate certificate:", err)
+		return fmt.Errorf("failed to generate certificate: %w", err)
 	}
 	cert, err := x509.ParseCertificate(certBytes)
 	if err != nil {
-		log.Fatalln("Failed to parse certificate:", err)
+		return fmt.Errorf("failed to parse certificate: %w", err)
 	}
-	if err := yk.SetCertificate(key, piv.SlotAuthentication, cert); err != nil {
-		log.Fatalln("Failed to store certificate:", err)
+	if err := yk.SetCertificate(key, slot, cert); err != nil {
+		return fmt.Errorf("failed to store certificate: %w", err)
 	}
+	return nil
+}
 
+// pinPolicies and touchPolicies are the policies that can be selected with
+// -pin-policy and -touch-policy.
+var pinPolicies = map[string]piv.PINPolicy{
+	"never":  piv.PINPolicyNever,
+	"once":   piv.PINPolicyOnce,
+	"always": piv.PINPolicyAlways,
+}
+
+var touchPolicies = map[string]piv.TouchPolicy{
+	"never":  piv.TouchPolicyNever,
+	"always": piv.TouchPolicyAlways,
+	"cached": piv.TouchPolicyCached,
+}
+
+// runGenerate implements -generate. It generates a new key in slot, without
+// touching the rest of the YubiKey, and prints its SSH public key. Unless
+// overwrite is set, it refuses to replace an existing key.
+func runGenerate(a *Agent, slot piv.Slot, opts piv.Key, overwrite bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.ensureYK(); err != nil {
+		log.Fatalln("Failed to connect to the YubiKey:", err)
+	}
+	defer a.closeYKs()
+	if len(a.yks) != 1 {
+		log.Fatalln("Multiple YubiKeys detected, select one with -serial.")
+	}
+	yk := a.yks[0]
+
+	if _, err := getPublicKey(yk.pivDevice, slot); err == nil {
+		if !overwrite {
+			log.Printf("‼️  YubiKey #%d PIV slot %s already has a key", yk.serial, slotName(slot))
+			log.Println("")
+			log.Fatalln("If you want to replace it, use -overwrite ⚠️")
+		}
+	} else if !errors.Is(err, ErrEmptySlot) {
+		log.Fatalf("Failed to access PIV slot %s: %v", slotName(slot), err)
+	}
+
+	key, err := a.managementKey(yk)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	pub, err := yk.GenerateKey(key, slot, opts)
+	if err != nil {
+		log.Fatalln("Failed to generate key:", err)
+	}
+	if err := storeCertificate(yk.pivDevice, key, slot, pub); err != nil {
+		log.Fatalln(err)
+	}
 	sshKey, err := ssh.NewPublicKey(pub)
 	if err != nil {
 		log.Fatalln("Failed to generate public key:", err)
 	}
 
-	fmt.Println("")
-	fmt.Println("✅ Done! This YubiKey is secured and ready to go.")
-	fmt.Println("🤏 When the YubiKey blinks, touch it to authorize the login.")
-	fmt.Println("")
-	fmt.Println("🔑 Here's your new shiny SSH public key:")
-	os.Stdout.Write(ssh.MarshalAuthorizedKey(sshKey))
-	fmt.Println("")
-	fmt.Println("Next steps: ensure yubikey-agent is running via launchd/systemd/...,")
-	fmt.Println(`set the SSH_AUTH_SOCK environment variable, and test with "ssh-add -L"`)
-	fmt.Println("")
-	fmt.Println("💭 Remember: everything breaks, have a backup plan for when this YubiKey does.")
+	fmt.Printf("✅ Done! Here's the SSH public key in PIV slot %s:\n", slotName(slot))
+	line := bytes.TrimSuffix(ssh.MarshalAuthorizedKey(sshKey), []byte("\n"))
+	fmt.Printf("%s %s\n", line, a.keyComment(yk, slot))
+}
+
+// managementKey returns the management key of yk. If it's stored on the
+// YubiKey protected by the PIN, like -setup does, the PIN is asked for.
+// Otherwise, the user is asked for the management key in hex, or to leave it
+// empty to use the default one.
+func (a *Agent) managementKey(yk *yubiKey) ([24]byte, error) {
+	pin, err := a.readSecret(yk, "Enter the PIN (to unlock the Management Key): ")
+	defer zeroBytes(pin)
+	if err != nil {
+		return [24]byte{}, fmt.Errorf("failed to read PIN: %w", err)
+	}
+	m, err := yk.Metadata(string(pin))
+	if err != nil {
+		return [24]byte{}, fmt.Errorf("failed to read the Management Key: %w", err)
+	}
+	if m.ManagementKey != nil {
+		return *m.ManagementKey, nil
+	}
+
+	fmt.Println("The Management Key is not stored on the YubiKey.")
+	h, err := a.readSecret(nil, "Enter the Management Key in hex (empty for the default): ")
+	defer zeroBytes(h)
+	if err != nil {
+		return [24]byte{}, fmt.Errorf("failed to read the Management Key: %w", err)
+	}
+	if len(h) == 0 {
+		return piv.DefaultManagementKey, nil
+	}
+	var key [24]byte
+	if n, err := hex.Decode(key[:], bytes.TrimSpace(h)); err != nil || n != len(key) {
+		return [24]byte{}, errors.New("the Management Key must be 48 hex characters")
+	}
+	return key, nil
+}
+
+// readSecret reads a secret from the terminal if available, and otherwise as
+// the PIN of yk, or with pinentry and the given prompt if yk is nil.
+func (a *Agent) readSecret(yk *yubiKey, prompt string) ([]byte, error) {
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Print(prompt)
+		defer fmt.Print("\n")
+		return terminal.ReadPassword(int(os.Stdin.Fd()))
+	}
+	if yk != nil {
+		return a.getPIN(yk, true)
+	}
+	if a.noPinentry {
+		return readPINFromStdin("", "")
+	}
+	p, err := newPinentry()
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+	p.set("title", "yubikey-agent")
+	p.set("prompt", prompt)
+	return p.command("GETPIN")
+}
+
+// readNewPIN asks the user to choose a new PIN, and to repeat it. It reads from
+// the terminal if available, and uses pinentry otherwise.
+func readNewPIN() []byte {
+	read := func(prompt string) ([]byte, error) {
+		fmt.Print(prompt)
+		defer fmt.Print("\n")
+		return terminal.ReadPassword(int(os.Stdin.Fd()))
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		read = func(prompt string) ([]byte, error) {
+			p, err := newPinentry()
+			if err != nil {
+				return nil, err
+			}
+			defer p.Close()
+			p.set("title", "yubikey-agent Setup")
+			p.set("desc", "The PIN is up to 8 numbers, letters, or symbols.")
+			p.set("prompt", prompt)
+			return p.command("GETPIN")
+		}
+	}
+
+	pin, err := read("Choose a new PIN/PUK: ")
+	if err != nil {
+		log.Fatalln("Failed to read PIN:", err)
+	}
+	repeat, err := read("Repeat PIN/PUK: ")
+	defer zeroBytes(repeat)
+	if err != nil {
+		log.Fatalln("Failed to read PIN:", err)
+	} else if !bytes.Equal(repeat, pin) {
+		log.Fatalln("PINs don't match!")
+	}
+	return pin
 }
 
 func randomSerialNumber() *big.Int {
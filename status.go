@@ -0,0 +1,138 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/go-piv/piv-go/piv"
+	"golang.org/x/crypto/ssh"
+)
+
+// runStatus prints the state of each connected YubiKey and of the keys in its
+// slots, without starting the agent.
+func runStatus(a *Agent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.ensureYK(); err != nil {
+		log.Fatalln("Failed to connect to the YubiKey:", err)
+	}
+	defer a.closeYKs()
+	for i, yk := range a.yks {
+		if i > 0 {
+			fmt.Println("")
+		}
+		v := yk.Version()
+		fmt.Printf("YubiKey #%d, firmware %d.%d.%d\n", yk.serial, v.Major, v.Minor, v.Patch)
+		if retries, err := yk.Retries(); err != nil {
+			fmt.Printf("PIN retries: unknown (%v)\n", err)
+		} else {
+			fmt.Printf("PIN retries: %d\n", retries)
+		}
+		fmt.Println("")
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SLOT\tALGORITHM\tPIN POLICY\tTOUCH POLICY\tFINGERPRINT")
+		for _, slot := range a.slots {
+			pk, err := getPublicKey(yk.pivDevice, slot)
+			if errors.Is(err, ErrEmptySlot) {
+				continue
+			}
+			if err != nil {
+				fmt.Fprintf(w, "%s\t(%v)\t\t\t\n", slotName(slot), err)
+				continue
+			}
+			pinPolicy, touchPolicy := "unknown", "unknown"
+			if att, err := attest(yk, slot); err == nil {
+				pinPolicy = pinPolicyName(att.PINPolicy)
+				touchPolicy = touchPolicyName(att.TouchPolicy)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", slotName(slot), pk.Type(),
+				pinPolicy, touchPolicy, ssh.FingerprintSHA256(pk))
+		}
+		w.Flush()
+	}
+}
+
+// runTestSign implements -test-sign. It signs a random challenge with the key
+// in slot of each YubiKey, through the same path as agent requests, and
+// verifies the signature, to check the key is usable before relying on it.
+// It exits with status 1 if any key fails.
+func runTestSign(a *Agent, slot piv.Slot) {
+	a.mu.Lock()
+	a.slots = []piv.Slot{slot}
+	a.mu.Unlock()
+	keys, err := a.List()
+	if err != nil {
+		log.Fatalln("Failed to list the keys:", err)
+	}
+	var tested, failed int
+	for _, k := range keys {
+		pk, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			log.Fatalln("Failed to parse the public key:", err)
+		}
+		if _, ok := pk.(*ssh.Certificate); ok {
+			continue
+		}
+		tested++
+		fmt.Printf("Testing %s (%s)... ", k.Comment, ssh.FingerprintSHA256(pk))
+		challenge := make([]byte, 32)
+		if _, err := rand.Read(challenge); err != nil {
+			log.Fatal(err)
+		}
+		sig, err := a.Sign(pk, challenge)
+		if err != nil {
+			failed++
+			fmt.Printf("❌ signature failed: %v\n", err)
+			continue
+		}
+		if err := pk.Verify(challenge, sig); err != nil {
+			failed++
+			fmt.Printf("❌ invalid %s signature: %v\n", sig.Format, err)
+			continue
+		}
+		fmt.Printf("✅ valid %s signature\n", sig.Format)
+	}
+	if tested == 0 {
+		log.Fatalf("No usable key found in PIV slot %s.", slotName(slot))
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func pinPolicyName(p piv.PINPolicy) string {
+	switch p {
+	case piv.PINPolicyNever:
+		return "never"
+	case piv.PINPolicyOnce:
+		return "once"
+	case piv.PINPolicyAlways:
+		return "always"
+	default:
+		return "unknown"
+	}
+}
+
+func touchPolicyName(p piv.TouchPolicy) string {
+	switch p {
+	case piv.TouchPolicyNever:
+		return "never"
+	case piv.TouchPolicyAlways:
+		return "always"
+	case piv.TouchPolicyCached:
+		return "cached"
+	default:
+		return "unknown"
+	}
+}
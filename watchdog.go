@@ -0,0 +1,84 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"time"
+)
+
+// pcscStuckThreshold is the number of consecutive PC/SC failures after which
+// the smart card service is considered stuck.
+const pcscStuckThreshold = 5
+
+// pcscSlowCall is how long connecting to the YubiKeys can take before a
+// warning is logged, as a stuck smart card service can also hang forever.
+const pcscSlowCall = 30 * time.Second
+
+// errPCSCStuck is returned after pcscStuckThreshold consecutive PC/SC
+// failures, to tell clients that the fix is restarting the smart card service,
+// rather than replugging the YubiKey.
+var errPCSCStuck = errors.New("the smart card service seems to be stuck, try restarting it")
+
+// pcscRestartHint returns how to restart the smart card service on the
+// current platform.
+func pcscRestartHint() string {
+	switch runtime.GOOS {
+	case "linux":
+		return "sudo systemctl restart pcscd"
+	case "darwin":
+		return "sudo pkill -9 com.apple.ctkpcscd, or reboot"
+	case "windows":
+		return `restart the "Smart Card" service from services.msc`
+	default:
+		return "restart pcscd"
+	}
+}
+
+// pcscFailed records a PC/SC failure, like piv.Cards or piv.Open failing for
+// reasons other than the YubiKey being in use. After pcscStuckThreshold in a
+// row, it logs a diagnostic, and wraps err with errPCSCStuck. Every attempt
+// establishes a new PC/SC context, so the agent recovers on its own once the
+// service does. It must be called with a.mu held.
+func (a *Agent) pcscFailed(err error) error {
+	a.pcscFailures++
+	if a.pcscFailures < pcscStuckThreshold {
+		return err
+	}
+	if a.pcscFailures == pcscStuckThreshold {
+		logEvent("error", "pcsc-stuck", "The smart card service keeps failing, it might need to be restarted with: "+pcscRestartHint(), logFields{
+			"failures": a.pcscFailures,
+			"platform": runtime.GOOS + "/" + runtime.GOARCH,
+			"error":    err.Error(),
+		})
+	}
+	return fmt.Errorf("%w (%v)", errPCSCStuck, err)
+}
+
+// pcscSucceeded resets the count of pcscFailed, logging if it recovered. It
+// must be called with a.mu held.
+func (a *Agent) pcscSucceeded() {
+	if a.pcscFailures >= pcscStuckThreshold {
+		log.Println("The smart card service recovered.")
+	}
+	a.pcscFailures = 0
+}
+
+// warnSlowPCSC logs a warning if the returned function is not called within
+// pcscSlowCall.
+func warnSlowPCSC() (done func()) {
+	t := time.AfterFunc(pcscSlowCall, func() {
+		logEvent("error", "pcsc-stuck", "Connecting to the YubiKeys is taking over "+pcscSlowCall.String()+
+			", the smart card service might be stuck, try: "+pcscRestartHint(), logFields{
+			"platform": runtime.GOOS + "/" + runtime.GOARCH,
+		})
+	})
+	return func() { t.Stop() }
+}